@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundle holds the regular files at the top level of a tar.gz archive in memory.  It is
+// an fs.FS so data can read from it in place of the OS.
+type bundle map[string][]byte
+
+// Open implements fs.FS.
+func (b bundle) Open(name string) (fs.File, error) {
+	c, ok := b[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &bundleFile{Reader: bytes.NewReader(c), name: name}, nil
+}
+
+// ReadDir implements fs.ReadDirFS for the top level of b.
+func (b bundle) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var e []fs.DirEntry
+	for n, c := range b {
+		e = append(e, &bundleFile{Reader: bytes.NewReader(c), name: n})
+	}
+
+	sort.Slice(e, func(i, j int) bool { return e[i].Name() < e[j].Name() })
+
+	return e, nil
+}
+
+// bundleFile is a file in a bundle.  It is also the fs.FileInfo and fs.DirEntry for the file.
+type bundleFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *bundleFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *bundleFile) Info() (fs.FileInfo, error) { return f, nil }
+func (f *bundleFile) Type() fs.FileMode          { return 0 }
+func (f *bundleFile) Close() error               { return nil }
+func (f *bundleFile) Name() string               { return f.name }
+func (f *bundleFile) Mode() fs.FileMode          { return 0444 }
+func (f *bundleFile) ModTime() time.Time         { return time.Time{} }
+func (f *bundleFile) IsDir() bool                { return false }
+func (f *bundleFile) Sys() interface{}           { return nil }
+
+// readArchive reads the gzipped tar archive in r into memory.  Only regular files at the top level of
+// the archive are kept, matching a directory made with fits-s3-upload.sh.
+func readArchive(r io.Reader) (bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	t := tar.NewReader(gz)
+	b := make(bundle)
+
+	for {
+		h, err := t.Next()
+		if errors.Is(err, io.EOF) {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(h.Name)
+		if h.Typeflag != tar.TypeReg || strings.Contains(name, "/") || name == "." || name == ".." {
+			continue
+		}
+
+		if b[name], err = io.ReadAll(t); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// scanArchive returns the observation files in b along with their source files using the same
+// naming rules as scan.
+func scanArchive(b bundle) []data {
+	var names []string
+	for n := range b {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var proc []data
+
+	for _, n := range names {
+		if isObservationFile(n, int64(len(b[n]))) {
+			proc = append(proc, data{
+				fsys:            b,
+				sourceFile:      sourceFileName(n),
+				observationFile: n,
+				mode:            defaultMode(),
+			})
+		}
+	}
+
+	return proc
+}
+
+// bundleMode returns the load mode for a bundle called name.  Bundles with names starting
+// with df. are loaded using delete-first unless another sync mode was selected on the command line.
+func bundleMode(name string) loadMode {
+	m := defaultMode()
+	if m == updateOrAddMode && strings.HasPrefix(path.Base(name), "df.") {
+		return deleteFirstMode
+	}
+
+	return m
+}
+
+// loadBundle loads the files in b and returns the exit code.  name is the bundle file name.
+func loadBundle(b bundle, name string) int {
+	proc := scanArchive(b)
+
+	m := bundleMode(name)
+	if m == deleteFirstMode && !deleteFirst {
+		log.Printf("using delete-first for %s", name)
+	}
+
+	for i := range proc {
+		proc[i].mode = m
+	}
+
+	if err := checkManifest(b, proc); err != nil {
+		log.Printf("ERROR - rejecting %s: %s", name, err)
+		return exitFailed
+	}
+
+	log.Printf("found %d observation files to process in %s", len(proc), name)
+
+	start := time.Now().UTC()
+	loadID = newLoadID(start)
+
+	startBundle(b, name, start)
+
+	code := loadAll(proc)
+
+	if err := finish(start, proc); err != nil && code == exitOK {
+		code = exitFailed
+	}
+
+	finishLoad(proc)
+
+	return code
+}
+
+// startBundle records the start of the load from b.  name is the bundle file name.
+func startBundle(b bundle, name string, start time.Time) {
+	if !recording() {
+		return
+	}
+
+	sum, err := fsChecksum(b)
+	if err != nil {
+		log.Printf("ERROR - checksum for load %s: %s", loadID, err)
+	}
+
+	startLoad(mode(), name, sum, start)
+}
+
+// loadArchive loads the tar.gz archive at archivePath, or from stdin if archivePath is -, and
+// returns the exit code.
+func loadArchive() int {
+	if !locValid {
+		if err := config.initDB(); err != nil {
+			fatal(err)
+		}
+		defer db.Close()
+	}
+
+	r := os.Stdin
+	name := "stdin"
+
+	if archivePath != "-" {
+		f, err := os.Open(archivePath)
+		if err != nil {
+			log.Print(err)
+			return exitConfig
+		}
+		defer f.Close()
+
+		r = f
+		name = archivePath
+	}
+
+	log.Printf("reading observation and source data from %s", name)
+	b, err := readArchive(r)
+	if err != nil {
+		log.Printf("ERROR - reading %s: %s", name, err)
+		return exitFailed
+	}
+
+	return loadBundle(b, name)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadArchive(t *testing.T) {
+	var b bytes.Buffer
+
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+
+	for _, n := range []string{"./VGT2_e.csv", "../escape.csv", "sub/VGT2_e.csv", "./VGT2_e.json", "./empty.csv"} {
+		c := []byte("a")
+		if n == "./empty.csv" {
+			c = nil
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: n, Mode: 0644, Size: int64(len(c)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tw.Close()
+	gz.Close()
+
+	a, err := readArchive(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a, bundle{"VGT2_e.csv": []byte("a"), "VGT2_e.json": []byte("a"), "empty.csv": []byte{}}) {
+		t.Errorf("expected only top level files to be read got %v", a)
+	}
+
+	proc := scanArchive(a)
+
+	if len(proc) != 1 || proc[0].observationFile != "VGT2_e.csv" || proc[0].sourceFile != "VGT2_e.json" {
+		t.Errorf("expected VGT2_e.csv and VGT2_e.json to be paired got %+v", proc)
+	}
+}
+
+func TestLoadBundle(t *testing.T) {
+	l := locValid
+	defer func() { locValid = l }()
+	locValid = true
+
+	a, err := readArchive(bytes.NewReader(tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json", "etc/errors/VGT2_e_dups.csv")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// there is no source file for VGT2_e_dups.csv
+	if c := loadBundle(a, "df.1234.tar.gz"); c != exitFailed {
+		t.Errorf("expected exit code %d got %d", exitFailed, c)
+	}
+
+	delete(a, "VGT2_e_dups.csv")
+
+	if c := loadBundle(a, "df.1234.tar.gz"); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if m := bundleMode("df.1234.tar.gz"); m != deleteFirstMode {
+		t.Errorf("expected delete-first for a df. bundle got %s", m)
+	}
+
+	if m := bundleMode("1234.tar.gz"); m != updateOrAddMode {
+		t.Errorf("expected update-or-add got %s", m)
+	}
+}
+
+// tarball returns a gzipped tar archive of files in the same layout as fits-s3-upload.sh.
+func tarball(t *testing.T, files ...string) []byte {
+	var b bytes.Buffer
+
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+
+	for _, n := range files {
+		f, err := os.Open(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tw.WriteHeader(&tar.Header{Name: "./" + filepath.Base(n), Mode: 0644, Size: i.Size(), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = io.Copy(tw, f); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
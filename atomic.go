@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// atomicLoad is true if all the files in a run are loaded in a single transaction.
+var atomicLoad bool
+
+// errRolledBack is the error for files that were not saved because the atomic load was rolled back.
+var errRolledBack = errors.New("not saved, the load was rolled back")
+
+// loadAtomic validates all of proc and then, only if every file is valid, saves them all in a single
+// transaction.  If any file fails nothing is saved.  For a staged load the observations are written
+// to the staging table and only published if they pass verification, never with --verify-only.  It
+// returns the exit code in the same way as loadAll.
+func loadAtomic(proc []data) int {
+	var failed int
+
+	for i := range proc {
+		if err := validate(&proc[i]); err != nil {
+			log.Printf("ERROR - processing %s: %s", proc[i].observationFile, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("ERROR - %d of %d files failed validation, not loading any files", failed, len(proc))
+		return exitFailed
+	}
+
+	if dryRun || locValid {
+		return exitOK
+	}
+
+	return saveAll(proc, nil)
+}
+
+// saveAll saves all of proc, which have been validated, in a single transaction.  If check is not nil
+// it is called before anything is saved and nothing is saved if it returns an error.  It returns the
+// exit code in the same way as loadAll.
+func saveAll(proc []data, check func(tx *sql.Tx) error) int {
+	err := withTx(func(tx *sql.Tx) error {
+		var s *staging
+
+		if check != nil {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+
+		if stagingLoad {
+			var err error
+			if s, err = newStaging(tx); err != nil {
+				return err
+			}
+		}
+
+		for i := range proc {
+			d := &proc[i]
+
+			// the ledger is read in tx as the pool may have no other connection.
+			skip, err := d.skip(tx)
+			if err != nil {
+				d.err = err
+				return err
+			}
+			if skip {
+				continue
+			}
+
+			if s != nil {
+				err = s.save(tx, d)
+			} else {
+				err = d.save(tx)
+			}
+			if err != nil {
+				d.err = err
+				return err
+			}
+		}
+
+		if s == nil {
+			return nil
+		}
+
+		if err := s.verify(tx); err != nil {
+			return err
+		}
+
+		if verifyOnly {
+			return errVerifyOnly
+		}
+
+		return s.publish(tx)
+	})
+
+	if errors.Is(err, errVerifyOnly) {
+		for i := range proc {
+			proc[i].unsave()
+		}
+
+		log.Printf("verified all staged series, rolled back without publishing")
+
+		return exitOK
+	}
+
+	if err != nil {
+		for i := range proc {
+			proc[i].unsave()
+			if proc[i].err == nil && !proc[i].skipped {
+				proc[i].err = errRolledBack
+			}
+		}
+
+		log.Printf("ERROR - rolled back loading all files: %s", err)
+
+		// there is no point carrying on if the DB has gone away.
+		if err := db.Ping(); err != nil {
+			log.Printf("ERROR - DB not available: %s", err)
+			return exitConfig
+		}
+
+		return exitFailed
+	}
+
+	for i := range proc {
+		if !proc[i].skipped {
+			proc[i].logSaved()
+		}
+	}
+
+	return exitOK
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestLoadAtomic(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	a, err := readArchive(bytes.NewReader(tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json", "etc/errors/VGT2_e_dups.csv")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the duplicate times are only found when VGT2_e_dups.csv is saved, after VGT2_e.csv.
+	a["VGT2_e_dups.json"] = a["VGT2_e.json"]
+
+	proc := scanArchive(a)
+
+	if c := loadAtomic(proc); c != exitFailed {
+		t.Errorf("expected exit code %d got %d", exitFailed, c)
+	}
+
+	if countObs(t) != 0 || countSites(t) != 0 {
+		t.Error("expected nothing saved after the load was rolled back")
+	}
+
+	for _, d := range proc {
+		if d.siteSaved || d.written != 0 {
+			t.Errorf("expected no outcome for %s after the rollback", d.observationFile)
+		}
+	}
+
+	if !errors.Is(proc[0].err, errRolledBack) {
+		t.Errorf("expected %s to be rolled back got %v", proc[0].observationFile, proc[0].err)
+	}
+
+	delete(a, "VGT2_e_dups.csv")
+	delete(a, "VGT2_e_dups.json")
+
+	proc = scanArchive(a)
+
+	if c := loadAtomic(proc); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("didn't find 7 observations in the DB.")
+	}
+}
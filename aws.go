@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var awsEndpoint, awsRegion string
+
+// awsFlags adds the flags for connecting to AWS services.
+func awsFlags() {
+	flag.StringVar(&awsEndpoint, "aws-endpoint", "", "optional endpoint URL for SQS and S3 e.g., for a local stand-in.")
+	flag.StringVar(&awsRegion, "aws-region", "ap-southeast-2", "AWS region for SQS and S3.")
+}
+
+// awsConfig returns the default AWS config for awsRegion.
+func awsConfig(ctx context.Context) (aws.Config, error) {
+	return awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(awsRegion))
+}
+
+// newS3Client returns an S3 client that uses awsEndpoint if it is set.
+func newS3Client(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if awsEndpoint != "" {
+			o.BaseEndpoint = aws.String(awsEndpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
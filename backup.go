@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// backupDB is true if the observations removed by a sync are copied to fits.loader_backup.
+	backupDB bool
+	// backupDir is the optional directory the observations removed by a sync are written to.
+	backupDir string
+	// loadID identifies the current load in backups.  It is set from the start time of each load.
+	loadID string
+)
+
+// newLoadID returns the load ID for a load started at t.  It is the start time followed by a random
+// suffix so loaders that start at the same time have different IDs.
+func newLoadID(t time.Time) string {
+	b := make([]byte, 4)
+
+	var suffix string
+	if _, err := rand.Read(b); err == nil {
+		suffix = hex.EncodeToString(b)
+	} else {
+		suffix = fmt.Sprintf("%08x", os.Getpid())
+	}
+
+	return t.UTC().Format("20060102T150405.000000Z") + "-" + suffix
+}
+
+// backup copies the observations in the series k that a sync of d is about to delete to
+// fits.loader_backup and/or writes them to an observation and source file in backupDir.  Nothing is
+// written when there are no observations to delete.
+func (d *data) backup(tx *sql.Tx, k seriesKey) error {
+	if backupDB {
+		if err := d.backupTable(tx, k); err != nil {
+			return err
+		}
+	}
+
+	if backupDir != "" {
+		if err := d.backupFile(tx, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupTable copies the observations in the series k that a sync of d is about to delete to
+// fits.loader_backup.  They are rolled back along with the delete if tx fails.
+func (d *data) backupTable(tx *sql.Tx, k seriesKey) error {
+	where, args := d.scope(k)
+
+	p := d.Properties
+	n := len(args)
+
+	args = append(args, loadID, d.observationFile, p.SiteID, p.TypeID, p.MethodID, p.SampleID, p.SystemID)
+
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO fits.loader_backup(load_id, observation_file, siteID, typeID, methodID, sampleID, systemID, time, value, error)
+				SELECT $%d::text, $%d::text, $%d::text, $%d::text, $%d::text, $%d::text, $%d::text, time, value, error FROM %s %s`,
+		n+1, n+2, n+3, n+4, n+5, n+6, n+7, d.obsTable(), where), args...)
+	if err != nil {
+		return err
+	}
+
+	c, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if c > 0 {
+		log.Printf("backed up %d observations for %s to fits.loader_backup load %s", c, d.seriesName(), loadID)
+	}
+
+	return nil
+}
+
+// backupFile writes the observations in the series k that a sync of d is about to delete to an
+// observation and source file in a directory for the load in backupDir.  The files have the same
+// name as the files for d and, for a windowed sync, the window is set in the source file so loading
+// them with --sync-window restores the observations.  The files are written before tx is committed so
+// they are left behind if it fails.
+func (d *data) backupFile(tx *sql.Tx, k seriesKey) error {
+	var unit string
+
+	err := tx.QueryRow(`SELECT symbol FROM fits.type JOIN fits.unit USING (unitpk) WHERE typepk = $1`, k.typePK).Scan(&unit)
+	if err != nil {
+		return err
+	}
+
+	where, args := d.scope(k)
+
+	rows, err := tx.Query(`SELECT time, value::text, error::text FROM `+d.obsTable()+` `+where+` ORDER BY time`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	dir := filepath.Join(backupDir, loadID)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Join(dir, filepath.Base(d.observationFile))
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	n, err := writeObsRows(f, d.Properties.TypeID, unit, rows)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return os.Remove(name)
+	}
+
+	s := d.source
+	s.Properties.WindowStart, s.Properties.WindowEnd, s.Properties.Duplicates = nil, nil, ""
+
+	if d.mode == syncWindowMode && !d.window.start.IsZero() {
+		s.Properties.WindowStart = &d.window.start
+	}
+
+	if d.mode == syncWindowMode && !d.window.end.IsZero() {
+		s.Properties.WindowEnd = &d.window.end
+	}
+
+	if f, err = os.Create(sourceFileName(name)); err != nil {
+		return err
+	}
+
+	if err = writeSource(f, s); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("backed up %d observations for %s to %s", n, d.seriesName(), name)
+
+	return nil
+}
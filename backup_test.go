@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLoadID(t *testing.T) {
+	s := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+	a, b := newLoadID(s), newLoadID(s)
+
+	if !strings.HasPrefix(a, "20240102T030405.000006Z-") || len(a) != len("20240102T030405.000006Z-")+8 {
+		t.Errorf("expected load ID 20240102T030405.000006Z-<8 hex digits> got %s", a)
+	}
+
+	if a == b {
+		t.Errorf("expected different load IDs for loads started at the same time got %s", a)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	if _, err := db.Exec(`DELETE FROM fits.loader_backup WHERE load_id = 'test'`); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		backupDB, backupDir, loadID = false, "", ""
+	}()
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	backupDB, backupDir, loadID = true, t.TempDir(), "test"
+
+	d.obs = d.obs[:2]
+
+	if err := d.deleteThenSave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if countObs(t) != 2 {
+		t.Error("didn't find 2 observations in the DB.")
+	}
+
+	var c int
+	if err := db.QueryRow(`SELECT count(*) FROM fits.loader_backup WHERE load_id = 'test' AND siteID = 'VGT2'`).Scan(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c != 7 {
+		t.Errorf("expected 7 observations in fits.loader_backup got %d", c)
+	}
+
+	b := data{
+		sourceFile:      filepath.Join(backupDir, "test", "VGT2_e.json"),
+		observationFile: filepath.Join(backupDir, "test", "VGT2_e.csv"),
+	}
+
+	if err := b.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.count() != 7 {
+		t.Errorf("expected 7 observations in the backup file got %d", b.count())
+	}
+
+	if b.Properties.SiteID != "VGT2" || b.Properties.TypeID != "e" || b.Properties.MethodID != "bernese5" {
+		t.Errorf("unexpected backup source %+v", b.Properties)
+	}
+
+	if _, err := db.Exec(`DELETE FROM fits.loader_backup WHERE load_id = 'test'`); err != nil {
+		t.Fatal(err)
+	}
+}
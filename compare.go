@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// liveSite is a site as it is in fits.site.
+type liveSite struct {
+	Name               string  `json:"name"`
+	Longitude          float64 `json:"longitude"`
+	Latitude           float64 `json:"latitude"`
+	Height             float64 `json:"height"`
+	GroundRelationship float64 `json:"groundRelationship"`
+}
+
+// obsCounts is what saving the observations for a file would do to the live series.
+type obsCounts struct {
+	Inserted  int64 `json:"inserted"`
+	Updated   int64 `json:"updated"`
+	Deleted   int64 `json:"deleted"`
+	Unchanged int64 `json:"unchanged"`
+}
+
+// liveSite returns the site for d from fits.site.  ok is false if there is no site.
+func (d *data) liveSite(tx *sql.Tx) (s liveSite, ok bool, err error) {
+	err = tx.QueryRow(`SELECT name, ST_X(location::geometry), ST_Y(location::geometry), height, ground_relationship
+				FROM fits.site WHERE siteID = $1`, d.Properties.SiteID).
+		Scan(&s.Name, &s.Longitude, &s.Latitude, &s.Height, &s.GroundRelationship)
+
+	switch err {
+	case nil:
+		return s, true, nil
+	case sql.ErrNoRows:
+		return s, false, nil
+	default:
+		return s, false, err
+	}
+}
+
+// siteChanges returns a description of each difference between the site in the source file for d
+// and s.
+func (d *data) siteChanges(s liveSite) (changes []string) {
+	p := d.Properties
+
+	if p.Name != s.Name {
+		changes = append(changes, fmt.Sprintf("name %q to %q", s.Name, p.Name))
+	}
+
+	if d.longitude() != s.Longitude || d.latitude() != s.Latitude {
+		changes = append(changes, fmt.Sprintf("location %g, %g to %g, %g", s.Longitude, s.Latitude, d.longitude(), d.latitude()))
+	}
+
+	if p.Height != s.Height {
+		changes = append(changes, fmt.Sprintf("height %g to %g", s.Height, p.Height))
+	}
+
+	if p.GroundRelationship != s.GroundRelationship {
+		changes = append(changes, fmt.Sprintf("ground relationship %g to %g", s.GroundRelationship, p.GroundRelationship))
+	}
+
+	return changes
+}
+
+// compareObs copies the observations for d to loader_observation and counts what saving them
+// would do to the live series k using d.mode.  Nothing is changed in the live tables.  The copy is
+// dropped before returning.
+func (d *data) compareObs(tx *sql.Tx, k seriesKey) (c obsCounts, err error) {
+	if err = d.copyObs(tx); err != nil {
+		return c, err
+	}
+
+	err = tx.QueryRow(`SELECT
+				count(*) FILTER (WHERE o.time IS NULL),
+				count(*) FILTER (WHERE o.time IS NOT NULL AND (o.value <> l.value OR o.error <> l.error)),
+				count(*) FILTER (WHERE o.value = l.value AND o.error = l.error)
+				FROM loader_observation l
+				LEFT JOIN fits.observation o
+				ON o.sitepk = $1 AND o.typepk = $2 AND o.methodpk = $3 AND o.samplepk = $4 AND o.time = l.time`,
+		k.sitePK, k.typePK, k.methodPK, k.samplePK).Scan(&c.Inserted, &c.Updated, &c.Unchanged)
+	if err != nil {
+		return c, err
+	}
+
+	if d.mode != updateOrAddMode {
+		q, args := d.removedQuery(k, "count(*)")
+
+		if err = tx.QueryRow(q, args...).Scan(&c.Deleted); err != nil {
+			return c, err
+		}
+	}
+
+	_, err = tx.Exec(`DROP TABLE loader_observation`)
+
+	return c, err
+}
+
+// removedQuery returns a query, and its arguments, that selects cols for the observations in the
+// series k that would be deleted by a sync of d because they are not in loader_observation.
+func (d *data) removedQuery(k seriesKey, cols string) (string, []interface{}) {
+	where, args := d.scope(k)
+
+	q := `SELECT ` + cols + ` FROM ` + d.obsTable() + ` o ` + where + `
+			AND NOT EXISTS (SELECT 1 FROM loader_observation l WHERE l.time = o.time)`
+
+	return q, args
+}
+
+// seriesState returns a fingerprint of the live observations for the series k.  It changes if any
+// observation in the series is added, removed, or changed.
+func seriesState(tx *sql.Tx, k seriesKey) (s string, err error) {
+	var n int64
+
+	err = tx.QueryRow(`SELECT count(*),
+				coalesce(sum(hashtext(extract(epoch FROM time)::text || ' ' || value::text || ' ' || error::text)::numeric), 0)::text
+				FROM fits.observation
+				WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`,
+		k.sitePK, k.typePK, k.methodPK, k.samplePK).Scan(&n, &s)
+
+	return fmt.Sprintf("%d/%s", n, s), err
+}
@@ -3,24 +3,20 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"io/fs"
 	"os"
-	"strings"
 	"time"
-)
 
-var (
-	addObservation *sql.Stmt
-	addSite        *sql.Stmt
+	"github.com/lib/pq"
 )
 
+var addSite *sql.Stmt
+
+// batchSize is the number of observations read from an observation file and copied to the DB at a time.
+var batchSize = 1000
+
 // initData should be called after the db is available.
 func initData() (err error) {
-	// siteID, typeID, methodID, sampleID, systemID, time, value, error
-	addObservation, err = db.Prepare("SELECT fits.add_observation($1, $2, $3, $4, $5, $6, $7, $8)")
-	if err != nil {
-		return err
-	}
-
 	// siteID, name, longitude, latitude, height, ground_relationship
 	addSite, err = db.Prepare("SELECT fits.add_site($1, $2, $3, $4, $5, $6)")
 	if err != nil {
@@ -31,14 +27,115 @@ func initData() (err error) {
 }
 
 type data struct {
+	// fsys holds sourceFile and observationFile.  When it is nil they are read from the OS.
+	fsys                        fs.FS
 	sourceFile, observationFile string
 	source
 	observation
+	mode   loadMode
+	window window
+	// table is the table observations are written to.  fits.observation is used when it is empty.
+	table string
+	result
+}
+
+// obsTable returns the table observations for d are written to.
+func (d *data) obsTable() string {
+	if d.table == "" {
+		return "fits.observation"
+	}
+
+	return d.table
+}
+
+// loadMode is how observations are written to the DB.
+type loadMode int
+
+const (
+	updateOrAddMode loadMode = iota // updateOrAdd
+	deleteFirstMode                 // deleteThenSave for the whole series
+	syncWindowMode                  // deleteThenSave within a time window
+)
+
+func (m loadMode) String() string {
+	switch m {
+	case deleteFirstMode:
+		return "delete-first"
+	case syncWindowMode:
+		return "sync-window"
+	default:
+		return "update-or-add"
+	}
+}
+
+// result records the outcome of processing a source and observation file.
+type result struct {
+	parsed, validated, siteSaved bool
+	// skipped is true if the ledger shows the files have already been loaded.
+	skipped bool
+	// written is the number of observations saved by either write path.
+	deleted, inserted, updated, written int64
+	err                                 error
+}
+
+// window is a time range of observations to sync.  A zero start or end leaves that side unbounded.
+type window struct {
+	start, end time.Time
 }
 
+// setWindow sets the time window used by deleteThenSave.  Each end of the window is taken from
+// start or end when they are not zero, then from the source file, and finally from the time span
+// of the observations.  All observations must fall inside the window.
+func (d *data) setWindow(start, end time.Time) error {
+	d.window = window{}
+
+	if d.Properties.WindowStart != nil {
+		d.window.start = *d.Properties.WindowStart
+	}
+
+	if d.Properties.WindowEnd != nil {
+		d.window.end = *d.Properties.WindowEnd
+	}
+
+	if !start.IsZero() {
+		d.window.start = start
+	}
+
+	if !end.IsZero() {
+		d.window.end = end
+	}
+
+	if d.window.start.IsZero() || d.window.end.IsZero() {
+		first, last, ok := d.span()
+		if !ok {
+			return fmt.Errorf("no observations to set the sync window from for %s", d.observationFile)
+		}
+
+		if d.window.start.IsZero() {
+			d.window.start = first
+		}
+
+		if d.window.end.IsZero() {
+			d.window.end = last
+		}
+	}
+
+	if d.window.end.Before(d.window.start) {
+		return fmt.Errorf("sync window end %s is before start %s", d.window.end.Format(time.RFC3339Nano), d.window.start.Format(time.RFC3339Nano))
+	}
+
+	if first, last, ok := d.span(); ok && (first.Before(d.window.start) || last.After(d.window.end)) {
+		return fmt.Errorf("observations from %s to %s are not all inside the sync window", first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano))
+	}
+
+	return nil
+}
+
+// parseAndValidate reads and validates the source and observation files for d.  When d.streamed is
+// true the observations are checked but not kept in memory; they are read again when they are saved.
 func (d *data) parseAndValidate() (err error) {
 
-	b, err := os.ReadFile(d.sourceFile)
+	b, err := d.readFile(d.sourceFile)
 	if err != nil {
 		return err
 	}
@@ -47,91 +144,184 @@ func (d *data) parseAndValidate() (err error) {
 		return err
 	}
 
-	f, err := os.Open(d.observationFile)
+	if d.policy, err = d.duplicatePolicy(); err != nil {
+		return err
+	}
+
+	f, err := d.open(d.observationFile)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if err = d.read(f); err != nil {
+	if d.streamed {
+		err = d.scan(f, nil)
+	} else {
+		err = d.read(f)
+	}
+	if err != nil {
 		return err
 	}
 	f.Close()
+	d.parsed = true
 
 	if !locValid {
 		if err = d.valid(); err != nil {
 			return err
 		}
 	}
+	d.validated = true
 
 	return err
 }
 
+// open opens name from d.fsys or the OS.
+func (d *data) open(name string) (fs.File, error) {
+	if d.fsys == nil {
+		return os.Open(name)
+	}
+
+	return d.fsys.Open(name)
+}
+
+// readFile reads name from d.fsys or the OS.
+func (d *data) readFile(name string) ([]byte, error) {
+	if d.fsys == nil {
+		return os.ReadFile(name)
+	}
+
+	return fs.ReadFile(d.fsys, name)
+}
+
 // updateOrAdd saves data to by d to the FITS DB.  If
 // an observation already exists for the source timestamp then the value and error are updated
-// otherwise the data is inserted.
-func (d *data) updateOrAdd() (err error) {
-	for _, o := range d.obs {
-		_, err = addObservation.Exec(
-			d.Properties.SiteID,
-			d.Properties.TypeID,
-			d.Properties.MethodID,
-			d.Properties.SampleID,
-			d.Properties.SystemID,
-			o.t,
-			o.v,
-			o.e)
-		if err != nil {
-			return err
-		}
+// otherwise the data is inserted.  This is done in a transaction so either all or none of the file
+// is saved.  The number of rows updated and inserted are stored in d.
+func (d *data) updateOrAdd() error {
+	err := withTx(d.updateOrAddTx)
+	if err != nil {
+		d.written, d.updated, d.inserted = 0, 0, 0
 	}
 
 	return err
 }
 
-// deleteThenSave saves data to the FITS db.  Observations for the source are first deleted and then
-// values in *obs added.  This is done in a transaction.
-func (d *data) deleteThenSave() (err error) {
+// updateOrAddTx is updateOrAdd using tx.  Observations are copied to a temporary table and merged.
+func (d *data) updateOrAddTx(tx *sql.Tx) error {
+	d.written, d.updated, d.inserted = 0, 0, 0
+
+	k, err := d.seriesKey(tx)
+	if err != nil {
+		return err
+	}
+
+	if err = d.copyObs(tx); err != nil {
+		return err
+	}
+
+	var written, inserted int64
 
+	// xmax is 0 for a newly inserted row.
+	err = tx.QueryRow(fmt.Sprintf(`WITH u AS (
+				INSERT INTO %s(sitePK, typePK, methodPK, samplePK, time, value, error)
+				SELECT $1::bigint, $2::bigint, $3::bigint, $4::bigint, time, value, error FROM loader_observation
+				ON CONFLICT (sitePK, typePK, methodPK, samplePK, time)
+				DO UPDATE SET value = EXCLUDED.value, error = EXCLUDED.error
+				RETURNING (xmax = 0) AS inserted
+				)
+				SELECT count(*), count(*) FILTER (WHERE inserted) FROM u`, d.obsTable()),
+		k.sitePK, k.typePK, k.methodPK, k.samplePK).Scan(&written, &inserted)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DROP TABLE loader_observation`); err != nil {
+		return err
+	}
+
+	d.written = written
+	d.inserted = inserted
+	d.updated = written - inserted
+
+	return nil
+}
+
+// scope returns a WHERE clause, and its arguments, for the observations in the series k replaced by a
+// sync of d.  For a windowed sync only the observations inside the window are replaced.
+func (d *data) scope(k seriesKey) (string, []interface{}) {
+	where := `WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`
+
+	args := []interface{}{k.sitePK, k.typePK, k.methodPK, k.samplePK}
+
+	if !d.window.start.IsZero() {
+		args = append(args, d.window.start)
+		where += fmt.Sprintf(" AND time >= $%d", len(args))
+	}
+
+	if !d.window.end.IsZero() {
+		args = append(args, d.window.end)
+		where += fmt.Sprintf(" AND time <= $%d", len(args))
+	}
+
+	return where, args
+}
+
+// withTx calls f with a new transaction.  The transaction is committed if f succeeds and
+// rolled back if it does not.
+func withTx(f func(*sql.Tx) error) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
-	var sitePK int
+	if err = f(tx); err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			fmt.Printf("error in rollback of DB transaction: %v\n", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// seriesKey holds the primary keys that, along with time, identify an observation in fits.observation.
+type seriesKey struct {
+	sitePK, typePK, methodPK, samplePK int
+}
+
+// seriesKey looks up the primary keys for the series described by d.Properties.
+func (d *data) seriesKey(tx *sql.Tx) (k seriesKey, err error) {
 	err = tx.QueryRow(`SELECT DISTINCT ON (sitepk) sitepk
-				FROM fits.site WHERE siteid = $1`, d.Properties.SiteID).Scan(&sitePK)
+				FROM fits.site WHERE siteid = $1`, d.Properties.SiteID).Scan(&k.sitePK)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("couldn't get sitePK for %s", d.Properties.SiteID)
+		return k, fmt.Errorf("couldn't get sitePK for %s", d.Properties.SiteID)
 	}
 	if err != nil {
-		return err
+		return k, err
 	}
 
-	var samplePK int
 	err = tx.QueryRow(`SELECT DISTINCT ON (samplePK) samplePK
 				FROM fits.sample join fits.system using (systempk)
 				WHERE sampleID = $1
 				AND
-				systemID = $2`, d.Properties.SampleID, d.Properties.SystemID).Scan(&samplePK)
+				systemID = $2`, d.Properties.SampleID, d.Properties.SystemID).Scan(&k.samplePK)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("couldn't get samplePK for %s.%s", d.Properties.SampleID, d.Properties.SystemID)
+		return k, fmt.Errorf("couldn't get samplePK for %s.%s", d.Properties.SampleID, d.Properties.SystemID)
 	}
 	if err != nil {
-		return err
+		return k, err
 	}
 
-	var methodPK int
-	err = tx.QueryRow(`SELECT methodPK FROM fits.method WHERE methodID = $1`, d.Properties.MethodID).Scan(&methodPK)
+	err = tx.QueryRow(`SELECT methodPK FROM fits.method WHERE methodID = $1`, d.Properties.MethodID).Scan(&k.methodPK)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("couldn't get methodPK for %s", d.Properties.MethodID)
+		return k, fmt.Errorf("couldn't get methodPK for %s", d.Properties.MethodID)
 	}
 	if err != nil {
-		return err
+		return k, err
 	}
 
 	// also checks that the type is valid for this method.
-	var typePK int
 	err = tx.QueryRow(`SELECT DISTINCT ON (typePK) typePK
 				FROM fits.type
 				JOIN fits.type_method USING (typepk)
@@ -139,58 +329,210 @@ func (d *data) deleteThenSave() (err error) {
 				WHERE
 				typeid = $1
 				AND
-				 methodid = $2`, d.Properties.TypeID, d.Properties.MethodID).Scan(&typePK)
+				 methodid = $2`, d.Properties.TypeID, d.Properties.MethodID).Scan(&k.typePK)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("couldn't get typePK for %s.%s", d.Properties.TypeID, d.Properties.MethodID)
+		return k, fmt.Errorf("couldn't get typePK for %s.%s", d.Properties.TypeID, d.Properties.MethodID)
 	}
+
+	return k, err
+}
+
+// deleteThenSave saves data to the FITS db.  Observations for the series (site, type, method, and sample)
+// are first deleted and then values in *obs added.  Observations for other methods or samples at the
+// same site and type are not changed.  If d.window is set only observations inside the window are
+// deleted.  This is done in a transaction.  The number of rows deleted and inserted are stored in d.
+func (d *data) deleteThenSave() error {
+	err := withTx(d.deleteThenSaveTx)
+	if err != nil {
+		d.written, d.deleted, d.inserted = 0, 0, 0
+	}
+
+	return err
+}
+
+// deleteThenSaveTx is deleteThenSave using tx.  Observations are streamed to a temporary table with COPY
+// and then merged so memory use does not grow with the file size.
+func (d *data) deleteThenSaveTx(tx *sql.Tx) error {
+	d.written, d.updated, d.deleted, d.inserted = 0, 0, 0, 0
+
+	k, err := d.seriesKey(tx)
 	if err != nil {
 		return err
 	}
 
-	obsDelete, err := tx.Prepare(`DELETE FROM fits.observation
-					WHERE
-					sitepk = (SELECT DISTINCT ON (sitepk) sitepk FROM fits.site WHERE siteid = $1)
-					AND
-					typePK = (SELECT DISTINCT ON (typepk)  typepk FROM fits.type WHERE typeid = $2)
-					`)
+	if err = d.copyObs(tx); err != nil {
+		return err
+	}
+
+	if err = d.checkThresholds(tx, k); err != nil {
+		return err
+	}
+
+	if err = d.backup(tx, k); err != nil {
+		return err
+	}
+
+	where, args := d.scope(k)
+
+	res, err := tx.Exec(`DELETE FROM `+d.obsTable()+` `+where, args...)
 	if err != nil {
 		return err
 	}
-	defer obsDelete.Close()
 
-	insert := `INSERT INTO fits.observation(sitePK, typePK, methodPK, samplePK, time, value, error) VALUES `
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-	var row string
-	for _, v := range d.obs {
-		row = fmt.Sprintf("(%d, %d, %d, %d, '%s'::timestamptz, %f, %f),", sitePK, typePK, methodPK, samplePK, v.t.Format(time.RFC3339), v.v, v.e)
-		insert += row
+	res, err = tx.Exec(`INSERT INTO `+d.obsTable()+`(sitePK, typePK, methodPK, samplePK, time, value, error)
+				SELECT $1::bigint, $2::bigint, $3::bigint, $4::bigint, time, value, error FROM loader_observation`,
+		k.sitePK, k.typePK, k.methodPK, k.samplePK)
+	if err != nil {
+		return err
 	}
 
-	insert = strings.TrimSuffix(insert, ",")
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-	obsInsert, err := tx.Prepare(insert)
+	if _, err = tx.Exec(`DROP TABLE loader_observation`); err != nil {
+		return err
+	}
+
+	d.deleted, d.inserted, d.written = deleted, inserted, inserted
+
+	return nil
+}
+
+// copyObs streams the observations for d to the temporary table loader_observation using COPY and
+// then resolves duplicate times in the table.  The table must be dropped before the next file is copied
+// in the same transaction; it is dropped when tx ends if there is an error.
+func (d *data) copyObs(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TEMPORARY TABLE loader_observation (
+				file_row INTEGER NOT NULL,
+				time TIMESTAMP(6) WITH TIME ZONE NOT NULL,
+				file_time TEXT NOT NULL,
+				value NUMERIC NOT NULL,
+				error NUMERIC NOT NULL
+				) ON COMMIT DROP`)
 	if err != nil {
 		return err
 	}
-	defer obsInsert.Close()
 
-	_, err = obsDelete.Exec(d.Properties.SiteID, d.Properties.TypeID)
+	stmt, err := tx.Prepare(pq.CopyIn("loader_observation", "file_row", "time", "file_time", "value", "error"))
 	if err != nil {
-		rollbackErr := tx.Rollback()
-		if rollbackErr != nil {
-			fmt.Printf("error in rollback of DB delete transaction: %v\n", rollbackErr)
+		return err
+	}
+	defer stmt.Close()
+
+	err = d.each(func(b []obs) error {
+		for _, o := range b {
+			if _, err := stmt.Exec(o.row, o.t, o.ts, o.vs, o.es); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	_, err = obsInsert.Exec()
+	// flush the copy.
+	if _, err = stmt.Exec(); err != nil {
+		return err
+	}
+
+	if err = stmt.Close(); err != nil {
+		return err
+	}
+
+	return d.copiedDuplicates(tx)
+}
+
+// each calls emit with the observations for d batchSize at a time.  When d was streamed they are read
+// again from the observation file.
+func (d *data) each(emit func([]obs) error) error {
+	if !d.streamed {
+		for i := 0; i < len(d.obs); i += batchSize {
+			if err := emit(d.obs[i:min(i+batchSize, len(d.obs))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := d.open(d.observationFile)
 	if err != nil {
-		rollbackErr := tx.Rollback()
-		if rollbackErr != nil {
-			fmt.Printf("error in rollback of DB insert transaction: %v\n", rollbackErr)
+		return err
+	}
+	defer f.Close()
+
+	var o observation
+
+	if err = o.scan(f, emit); err != nil {
+		return err
+	}
+	d.n = o.n
+
+	return nil
+}
+
+// copiedDuplicates finds times that are in more than one row of loader_observation and resolves them
+// using d.policy.  Only the rows for duplicate times are read from the DB.  When duplicates are rejected
+// a *validationErrors is returned.
+func (d *data) copiedDuplicates(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT file_row, time, file_time, value::text, error::text FROM loader_observation
+				WHERE time IN (SELECT time FROM loader_observation GROUP BY time HAVING count(*) > 1)
+				ORDER BY file_row`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var all []obs
+
+	for rows.Next() {
+		var o obs
+		if err = rows.Scan(&o.row, &o.t, &o.ts, &o.vs, &o.es); err != nil {
+			return err
 		}
+		o.v = parseDecimal(o.vs)
+		o.e = parseDecimal(o.es)
+		all = append(all, o)
+	}
+
+	if err = rows.Err(); err != nil {
 		return err
 	}
+	rows.Close()
 
-	return tx.Commit()
+	if len(all) == 0 {
+		return nil
+	}
+
+	dups := findDuplicates(all)
+
+	var v validationErrors
+	d.resolveDuplicates(dups, &v)
+
+	if len(v.errs) > 0 {
+		return &v
+	}
+
+	for _, g := range dups {
+		if _, err = tx.Exec(`DELETE FROM loader_observation WHERE time = $1`, g.t); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO loader_observation(file_row, time, file_time, value, error) VALUES ($1, $2, $3, $4::numeric, $5::numeric)`,
+			g.kept.row, g.kept.t, g.kept.ts, g.kept.vs, g.kept.es)
+		if err != nil {
+			return err
+		}
+
+		d.n -= len(g.rows) - 1
+	}
+
+	return nil
 }
@@ -2,6 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,6 +40,185 @@ func TestUpdateOrAdd(t *testing.T) {
 	if countObs(t) != 7 {
 		t.Error("didn't find 7 observations in the DB.")
 	}
+
+	if d.inserted != 7 || d.updated != 0 {
+		t.Errorf("expected 7 inserted and 0 updated got %d and %d", d.inserted, d.updated)
+	}
+
+	// loading the same file again updates every observation.
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.inserted != 0 || d.updated != 7 {
+		t.Errorf("expected 0 inserted and 7 updated got %d and %d", d.inserted, d.updated)
+	}
+}
+
+func TestUpdateOrAddRollback(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	defer func(n int) { batchSize = n }(batchSize)
+	batchSize = 2
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a repeated time in the last batch fails the file after the earlier batches have been copied.
+	d.obs = append(d.obs, d.obs[len(d.obs)-1])
+
+	if err := d.updateOrAdd(); err == nil {
+		t.Fatal("expected an error for a repeated time")
+	}
+
+	if countObs(t) != 0 {
+		t.Error("expected the whole file to be rolled back")
+	}
+
+	if d.written != 0 {
+		t.Errorf("expected 0 written got %d", d.written)
+	}
+}
+
+// TestStreamed checks that observations that are not kept in memory are read again from the
+// file and that duplicate times are resolved in the DB.
+func TestStreamed(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	defer func(n int, p string) { batchSize, duplicates = n, p }(batchSize, duplicates)
+	batchSize = 2
+	duplicates = "last"
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/errors/VGT2_e_dups.csv",
+		observation:     observation{streamed: true},
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.obs != nil {
+		t.Error("expected no observations in memory")
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []func() error{d.updateOrAdd, d.deleteThenSave} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(d.resolved) != 1 {
+			t.Errorf("expected 1 resolved duplicate got %d", len(d.resolved))
+		}
+
+		if c := countObs(t); c != d.count() || int64(c) != d.written {
+			t.Errorf("expected %d observations in the DB got %d, %d written", d.count(), c, d.written)
+		}
+	}
+
+	duplicates = "reject"
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var v *validationErrors
+	if err := d.deleteThenSave(); !errors.As(err, &v) {
+		t.Errorf("expected validation errors for duplicates got %v", err)
+	}
+}
+
+// benchData returns data for the test site with n daily observations.
+func benchData(b *testing.B, n int) data {
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		b.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		b.Fatal(err)
+	}
+
+	t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	d.obs = make([]obs, n)
+	for i := range d.obs {
+		v := float64(i) * 0.1
+		d.obs[i] = obs{t: t.AddDate(0, 0, i), v: v, e: 0.05, vs: strconv.FormatFloat(v, 'f', -1, 64), es: "0.05"}
+	}
+
+	return d
+}
+
+func BenchmarkUpdateOrAdd(b *testing.B) {
+	setup()
+	defer teardown()
+
+	cleanDB(b)
+
+	d := benchData(b, 7000)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := d.updateOrAdd(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddObservation writes the same observations as BenchmarkUpdateOrAdd one row at a time
+// with fits.add_observation for comparison.
+func BenchmarkAddObservation(b *testing.B) {
+	setup()
+	defer teardown()
+
+	cleanDB(b)
+
+	d := benchData(b, 7000)
+
+	add, err := db.Prepare("SELECT fits.add_observation($1, $2, $3, $4, $5, $6, $7, $8)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer add.Close()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, o := range d.obs {
+			_, err = add.Exec(d.Properties.SiteID, d.Properties.TypeID, d.Properties.MethodID, d.Properties.SampleID,
+				d.Properties.SystemID, o.t, o.v, o.e)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
 }
 
 func TestDeleteThenSave(t *testing.T) {
@@ -63,9 +246,11 @@ func TestDeleteThenSave(t *testing.T) {
 
 	// Save  observations with one additional one that is not in the file.
 	o := obs{
-		t: time.Now().UTC(),
-		v: 12.2,
-		e: 6.6,
+		t:  time.Now().UTC(),
+		v:  12.2,
+		e:  6.6,
+		vs: "12.2",
+		es: "6.6",
 	}
 
 	d.obs = append(d.obs, o)
@@ -105,8 +290,276 @@ func TestDeleteThenSave(t *testing.T) {
 	}
 }
 
+// TestDecimal checks that values and errors are stored exactly as written in the observation file
+// by both write paths.
+func TestDecimal(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	in := `date time, e (mm), error (mm)
+2012-07-31T12:01:04.000000Z,0.000000000000000000000000000012345678901234567890,1E-320
+2012-08-01T11:58:56.000000Z,123456789012345678901234567890.123456789,0.1
+2012-08-02T12:01:04.000000Z,-9.99999999999999999e300,0.30000000000000004441
+`
+
+	if err := d.read(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []func() error{d.updateOrAdd, d.deleteThenSave} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, o := range d.obs {
+			var c int
+			if err := db.QueryRow(`select count(*) from fits.observation
+				where time = $1 and value = $2::numeric and error = $3::numeric`, o.t, o.vs, o.es).Scan(&c); err != nil {
+				t.Fatal(err)
+			}
+
+			if c != 1 {
+				t.Errorf("didn't find %s with value %s and error %s", o.t.Format(time.RFC3339), o.vs, o.es)
+			}
+		}
+	}
+}
+
+// TestDeleteThenSaveEmpty checks that syncing a file with no observations removes the series.
+func TestDeleteThenSaveEmpty(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.obs = nil
+
+	if err := d.deleteThenSave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if countObs(t) != 0 {
+		t.Error("expected no observations in the DB.")
+	}
+
+	if d.deleted != 7 || d.inserted != 0 {
+		t.Errorf("expected 7 deleted and 0 inserted got %d and %d", d.deleted, d.inserted)
+	}
+}
+
+// TestDeleteThenSaveSeries checks that syncing one series leaves the observations
+// for other methods and samples at the same site and type untouched.
+func TestDeleteThenSaveSeries(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same observations for a sibling method and a sibling sample.
+	m := d
+	m.Properties.MethodID = "gamit"
+
+	if err := m.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d
+	s.Properties.SampleID = "A"
+
+	if err := s.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if countObs(t) != 21 {
+		t.Error("didn't find 21 observations in the DB.")
+	}
+
+	// sync bernese5 with fewer observations.
+	d.obs = d.obs[:3]
+
+	if err := d.deleteThenSave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := countSeriesObs(t, "bernese5", "none"); c != 3 {
+		t.Errorf("expected 3 bernese5 observations got %d", c)
+	}
+
+	if c := countSeriesObs(t, "gamit", "none"); c != 7 {
+		t.Errorf("expected 7 gamit observations got %d", c)
+	}
+
+	if c := countSeriesObs(t, "bernese5", "A"); c != 7 {
+		t.Errorf("expected 7 bernese5 observations for sample A got %d", c)
+	}
+}
+
+// TestDeleteThenSaveWindow checks that a windowed sync only replaces observations
+// inside the time span of the file.
+func TestDeleteThenSaveWindow(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save observations with one additional one that is outside the time span of the file.
+	d.obs = append(d.obs, obs{
+		t:  time.Now().UTC(),
+		v:  12.2,
+		e:  6.6,
+		vs: "12.2",
+		es: "6.6",
+	})
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if countObs(t) != 8 {
+		t.Error("didn't find 8 observations in the DB.")
+	}
+
+	// reload the file and drop an observation from inside the window.
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.obs = append(d.obs[:3], d.obs[4:]...)
+
+	if err := d.setWindow(time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.deleteThenSave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.deleted != 7 {
+		t.Errorf("expected 7 observations deleted got %d", d.deleted)
+	}
+
+	if d.inserted != 6 {
+		t.Errorf("expected 6 observations inserted got %d", d.inserted)
+	}
+
+	// the observation outside the window is kept.
+	if countObs(t) != 7 {
+		t.Error("didn't find 7 observations in the DB.")
+	}
+}
+
+func TestSetWindow(t *testing.T) {
+	d := data{
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	f, err := os.Open(d.observationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err = d.read(f); err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Date(2012, 7, 31, 12, 1, 4, 0, time.UTC)
+	last := time.Date(2012, 8, 6, 12, 1, 4, 0, time.UTC)
+
+	if err = d.setWindow(time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.window.start.Equal(first) || !d.window.end.Equal(last) {
+		t.Errorf("expected window from file %s to %s got %s to %s", first, last, d.window.start, d.window.end)
+	}
+
+	// the source file overrides the file and the command line overrides the source.
+	ws, we := first.Add(-time.Hour), last.Add(time.Hour)
+	d.Properties.WindowStart = &ws
+	d.Properties.WindowEnd = &we
+
+	if err = d.setWindow(time.Time{}, last.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.window.start.Equal(first.Add(-time.Hour)) || !d.window.end.Equal(last.Add(time.Minute)) {
+		t.Errorf("wrong window %s to %s", d.window.start, d.window.end)
+	}
+
+	if err = d.setWindow(time.Time{}, last.Add(-time.Minute)); err == nil {
+		t.Error("expected an error for observations outside the window")
+	}
+
+	if err = d.setWindow(last, first); err == nil {
+		t.Error("expected an error for window end before start")
+	}
+}
+
 // clean out all sites and observations from the DB.
-func cleanDB(t *testing.T) {
+func cleanDB(t testing.TB) {
 	if err := db.QueryRow("truncate fits.site cascade").Scan(); err != nil && err != sql.ErrNoRows {
 		t.Fatal(err)
 	}
@@ -129,3 +582,14 @@ func countSites(t *testing.T) (c int) {
 
 	return
 }
+
+func countSeriesObs(t *testing.T, methodID, sampleID string) (c int) {
+	if err := db.QueryRow(`select count(*) from fits.observation
+				join fits.method using (methodpk)
+				join fits.sample using (samplepk)
+				where methodid = $1 and sampleid = $2`, methodID, sampleID).Scan(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
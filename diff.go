@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// obsChange is an observation that differs between an observation file and the DB.  Old is empty
+// for an observation only in the file and new is empty for an observation only in the DB.
+type obsChange struct {
+	t                  time.Time
+	oldValue, oldError string
+	newValue, newError string
+}
+
+// seriesDiff is the differences between the site and observations for a file and the DB.
+type seriesDiff struct {
+	name, file string
+	// newSite is true if the site is not in the DB.
+	newSite                 bool
+	siteChanges             []string
+	added, removed, changed []obsChange
+}
+
+// diffDataDir compares each of the files in dataDir with the DB and writes the differences to
+// stdout.  Nothing is changed in the DB.  It returns the exit code.
+func diffDataDir() int {
+	if dataDir == "" {
+		fatal("please specify the data directory")
+	}
+
+	if dryRun || locValid || atomicLoad || stagingLoad || useLedger {
+		fatal("--dry-run, --local-validate, --atomic, --staging, and --ledger can't be used with diff")
+	}
+
+	log.Printf("searching for observation and source data in %s", dataDir)
+	proc, err := scan(dataDir)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	if err := config.initDB(); err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	code := exitOK
+
+	for i := range proc {
+		d := &proc[i]
+
+		s, err := d.diff()
+		if err != nil {
+			d.err = err
+			log.Printf("ERROR - comparing %s: %s", d.observationFile, err)
+			code = exitFailed
+			continue
+		}
+
+		s.write(os.Stdout)
+	}
+
+	if code != exitOK {
+		summary(os.Stdout, proc)
+	}
+
+	return code
+}
+
+// diff validates d and returns the differences between it and the DB.  The observations in
+// the DB for a sync within a window are only compared within the window.
+func (d *data) diff() (s seriesDiff, err error) {
+	if err = validate(d); err != nil {
+		return s, err
+	}
+
+	s = seriesDiff{name: d.seriesName(), file: d.observationFile}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return s, err
+	}
+	// nothing is changed by a diff.
+	defer tx.Rollback()
+
+	l, ok, err := d.liveSite(tx)
+	if err != nil {
+		return s, err
+	}
+
+	if ok {
+		s.siteChanges = d.siteChanges(l)
+	} else {
+		s.newSite = true
+	}
+
+	if err = d.copyObs(tx); err != nil {
+		return s, err
+	}
+
+	if !ok {
+		s.added, err = queryChanges(tx, `SELECT time, '', '', value::text, error::text FROM loader_observation ORDER BY time`)
+		return s, err
+	}
+
+	k, err := d.seriesKey(tx)
+	if err != nil {
+		return s, err
+	}
+
+	args := []interface{}{k.sitePK, k.typePK, k.methodPK, k.samplePK}
+
+	s.added, err = queryChanges(tx, `SELECT l.time, '', '', l.value::text, l.error::text
+				FROM loader_observation l
+				LEFT JOIN fits.observation o
+				ON o.sitepk = $1 AND o.typepk = $2 AND o.methodpk = $3 AND o.samplepk = $4 AND o.time = l.time
+				WHERE o.time IS NULL
+				ORDER BY l.time`, args...)
+	if err != nil {
+		return s, err
+	}
+
+	s.changed, err = queryChanges(tx, `SELECT l.time, o.value::text, o.error::text, l.value::text, l.error::text
+				FROM loader_observation l
+				JOIN fits.observation o
+				ON o.sitepk = $1 AND o.typepk = $2 AND o.methodpk = $3 AND o.samplepk = $4 AND o.time = l.time
+				WHERE o.value <> l.value OR o.error <> l.error
+				ORDER BY l.time`, args...)
+	if err != nil {
+		return s, err
+	}
+
+	q, args := d.removedQuery(k, `o.time, o.value::text, o.error::text, '', ''`)
+
+	s.removed, err = queryChanges(tx, q+` ORDER BY o.time`, args...)
+
+	return s, err
+}
+
+// queryChanges returns the obsChanges selected by q.  q must select the time, old value, old error,
+// new value, and new error.
+func queryChanges(tx *sql.Tx, q string, args ...interface{}) (c []obsChange, err error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o obsChange
+		if err = rows.Scan(&o.t, &o.oldValue, &o.oldError, &o.newValue, &o.newError); err != nil {
+			return nil, err
+		}
+		c = append(c, o)
+	}
+
+	return c, rows.Err()
+}
+
+// write writes the differences in s to w.  Observations only in the file are prefixed with +, those
+// only in the DB with -, and those that have changed with ~.
+func (s seriesDiff) write(w io.Writer) {
+	fmt.Fprintf(w, "--- fits %s\n", s.name)
+	fmt.Fprintf(w, "+++ %s\n", s.file)
+
+	if s.newSite {
+		fmt.Fprintln(w, "site: new")
+	}
+
+	for _, c := range s.siteChanges {
+		fmt.Fprintf(w, "site: %s\n", c)
+	}
+
+	for _, o := range s.removed {
+		fmt.Fprintf(w, "- %s value %s error %s\n", o.t.UTC().Format(time.RFC3339Nano), o.oldValue, o.oldError)
+	}
+
+	for _, o := range s.added {
+		fmt.Fprintf(w, "+ %s value %s error %s\n", o.t.UTC().Format(time.RFC3339Nano), o.newValue, o.newError)
+	}
+
+	for _, o := range s.changed {
+		fmt.Fprintf(w, "~ %s value %s to %s error %s to %s\n", o.t.UTC().Format(time.RFC3339Nano), o.oldValue, o.newValue, o.oldError, o.newError)
+	}
+
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(s.added), len(s.removed), len(s.changed))
+}
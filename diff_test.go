@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSeriesDiffWrite(t *testing.T) {
+	s := seriesDiff{
+		name:        "VGT2.e.bernese5.none",
+		file:        "etc/VGT2_e.csv",
+		siteChanges: []string{"height 10 to -999.9"},
+		added:       []obsChange{{t: time.Date(2012, 8, 6, 12, 1, 4, 0, time.UTC), newValue: "4.61", newError: "4.64"}},
+		removed:     []obsChange{{t: time.Date(2012, 9, 1, 0, 0, 0, 0, time.UTC), oldValue: "1", oldError: "1"}},
+		changed: []obsChange{{t: time.Date(2012, 8, 1, 11, 58, 56, 0, time.UTC), oldValue: "10", oldError: "4.48",
+			newValue: "1.07", newError: "4.48"}},
+	}
+
+	var b bytes.Buffer
+	s.write(&b)
+
+	e := `--- fits VGT2.e.bernese5.none
++++ etc/VGT2_e.csv
+site: height 10 to -999.9
+- 2012-09-01T00:00:00Z value 1 error 1
++ 2012-08-06T12:01:04Z value 4.61 error 4.64
+~ 2012-08-01T11:58:56Z value 10 to 1.07 error 4.48 to 4.48
+1 added, 1 removed, 1 changed
+`
+
+	if b.String() != e {
+		t.Errorf("expected:\n%s\ngot:\n%s", e, b.String())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	s, err := d.diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.newSite || len(s.added) != 7 || len(s.removed) != 0 || len(s.changed) != 0 {
+		t.Errorf("expected a new site and 7 added got %+v", s)
+	}
+
+	if err = withTx(d.save); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`DELETE FROM fits.observation WHERE time = '2012-08-06T12:01:04Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE fits.observation SET value = 10 WHERE time = '2012-08-01T11:58:56Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO fits.observation (sitepk, typepk, methodpk, samplepk, time, value, error)
+		SELECT sitepk, typepk, methodpk, samplepk, '2012-09-01T00:00:00Z', 1, 1 FROM fits.observation LIMIT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE fits.site SET name = 'Te Maari' WHERE siteID = 'VGT2'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if s, err = d.diff(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.newSite || len(s.siteChanges) != 1 || s.siteChanges[0] != `name "Te Maari" to "Te Maari 2"` {
+		t.Errorf("expected a name change got %v", s.siteChanges)
+	}
+
+	if len(s.added) != 1 || s.added[0].newValue != "4.61" || s.added[0].newError != "4.64" {
+		t.Errorf("expected 4.61 4.64 added got %+v", s.added)
+	}
+
+	if len(s.removed) != 1 || !s.removed[0].t.Equal(time.Date(2012, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 2012-09-01 removed got %+v", s.removed)
+	}
+
+	if len(s.changed) != 1 || s.changed[0].oldValue != "10" || s.changed[0].newValue != "1.07" {
+		t.Errorf("expected 10 changed to 1.07 got %+v", s.changed)
+	}
+}
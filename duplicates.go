@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// dupPolicy is how observations at the same time in an observation file are resolved.
+type dupPolicy int
+
+const (
+	rejectDuplicates  dupPolicy = iota // report duplicates as validation errors
+	keepFirst                          // keep the first row
+	keepLast                           // keep the last row
+	keepSmallestError                  // keep the row with the smallest error, the first if they are equal
+	averageDuplicates                  // use the mean of the values and of the errors
+)
+
+func (p dupPolicy) String() string {
+	switch p {
+	case keepFirst:
+		return "first"
+	case keepLast:
+		return "last"
+	case keepSmallestError:
+		return "smallest-error"
+	case averageDuplicates:
+		return "average"
+	default:
+		return "reject"
+	}
+}
+
+// duplicates is the policy set on the command line.  When it is empty the source file policy is used.
+var duplicates string
+
+// parseDupPolicy returns the dupPolicy called s.
+func parseDupPolicy(s string) (dupPolicy, error) {
+	for _, p := range []dupPolicy{rejectDuplicates, keepFirst, keepLast, keepSmallestError, averageDuplicates} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+
+	return rejectDuplicates, fmt.Errorf("unknown duplicates policy %q", s)
+}
+
+// duplicatePolicy returns the policy for d.  The command line takes precedence over the source
+// file.  Duplicates are rejected if neither is set.
+func (d *data) duplicatePolicy() (dupPolicy, error) {
+	switch {
+	case duplicates != "":
+		return parseDupPolicy(duplicates)
+	case d.Properties.Duplicates != "":
+		return parseDupPolicy(d.Properties.Duplicates)
+	default:
+		return rejectDuplicates, nil
+	}
+}
+
+// duplicate is a time that appears in more than one row of an observation file.
+type duplicate struct {
+	t    time.Time
+	rows []int
+	// collision is true if the times in the file are different but the same at timeResolution.
+	collision bool
+	// obs is every row for t and kept is the observation kept after resolving the duplicate.
+	obs  []obs
+	kept obs
+}
+
+// findDuplicates returns the times that are in more than one of all, in the order they are first seen.
+// all must be in row order.
+func findDuplicates(all []obs) []duplicate {
+	seen := make(map[int64]int)
+	var dups []duplicate
+	groups := make(map[int64]int)
+
+	for i, o := range all {
+		k := o.t.UnixMicro()
+
+		f, ok := seen[k]
+		if !ok {
+			seen[k] = i
+			continue
+		}
+
+		g, ok := groups[k]
+		if !ok {
+			g = len(dups)
+			groups[k] = g
+			dups = append(dups, duplicate{t: o.t, rows: []int{all[f].row}, obs: []obs{all[f]}})
+		}
+
+		dups[g].rows = append(dups[g].rows, o.row)
+		dups[g].obs = append(dups[g].obs, o)
+	}
+
+	return dups
+}
+
+// resolveDuplicates sets the observation kept for each of dups using o.policy and stores them in
+// o.resolved.  When duplicates are rejected every row after the first is added to v instead.
+// Times that are different in the file but the same at timeResolution are reported as collisions.
+func (o *observation) resolveDuplicates(dups []duplicate, v *validationErrors) {
+	o.resolved = nil
+
+	for i := range dups {
+		d := &dups[i]
+		first := fileTime(d.obs[0])
+
+		for _, r := range d.obs[1:] {
+			same := fileTime(r).Equal(first)
+			d.collision = d.collision || !same
+
+			if o.policy != rejectDuplicates {
+				continue
+			}
+
+			if same {
+				v.add(rowError{row: r.row, column: "date time", value: r.ts, reason: fmt.Sprintf("duplicate timestamp, first seen in row %d", d.rows[0])})
+			} else {
+				v.add(rowError{row: r.row, column: "date time", value: r.ts, reason: fmt.Sprintf("collides with row %d at %s resolution (%s)", d.rows[0], timeResolution, d.t.UTC().Format(time.RFC3339Nano))})
+			}
+		}
+
+		// a rejected duplicate keeps the first row so the other rows can be dropped.
+		var err error
+		if d.kept, err = o.policy.resolve(d.obs); err != nil {
+			v.add(rowError{row: d.rows[0], column: "date time", value: d.obs[0].ts, reason: fmt.Sprintf("error resolving duplicate timestamp: %s", err)})
+		}
+	}
+
+	if o.policy != rejectDuplicates {
+		o.resolved = dups
+	}
+}
+
+// fileTime returns the time for o as written in the observation file.
+func fileTime(o obs) time.Time {
+	// o.ts was parsed when the observation was read.
+	t, _ := time.Parse(time.RFC3339Nano, o.ts)
+	return t
+}
+
+// resolve returns the observation to keep from obs, which all have the same time.
+func (p dupPolicy) resolve(obs []obs) (obs, error) {
+	switch p {
+	case keepLast:
+		return obs[len(obs)-1], nil
+	case keepSmallestError:
+		r := obs[0]
+		for _, o := range obs[1:] {
+			if o.e < r.e {
+				r = o
+			}
+		}
+		return r, nil
+	case averageDuplicates:
+		r := obs[0]
+
+		var v, e []string
+		for _, o := range obs {
+			v = append(v, o.vs)
+			e = append(e, o.es)
+		}
+
+		var err error
+
+		if r.vs, err = mean(v); err != nil {
+			return r, fmt.Errorf("averaging values: %w", err)
+		}
+
+		if r.es, err = mean(e); err != nil {
+			return r, fmt.Errorf("averaging errors: %w", err)
+		}
+
+		r.v = parseDecimal(r.vs)
+		r.e = parseDecimal(r.es)
+
+		return r, nil
+	default:
+		return obs[0], nil
+	}
+}
+
+// mean returns the mean of the decimal numbers in s.  It is calculated exactly and written with
+// six more decimal places than the most precise number in s, up to the most a NUMERIC can store,
+// without trailing zeros.
+func mean(s []string) (string, error) {
+	var sum big.Rat
+	var places int
+
+	for _, v := range s {
+		r, ok := new(big.Rat).SetString(v)
+		if !ok {
+			return "", fmt.Errorf("can't average %s", v)
+		}
+		sum.Add(&sum, r)
+
+		if p := decimalPlaces(r); p > places {
+			places = p
+		}
+	}
+
+	sum.Quo(&sum, new(big.Rat).SetInt64(int64(len(s))))
+
+	m := sum.FloatString(min(places+6, maxFracDigits))
+	m = strings.TrimRight(m, "0")
+	m = strings.TrimSuffix(m, ".")
+
+	if m == "-0" {
+		m = "0"
+	}
+
+	return m, nil
+}
+
+// decimalPlaces returns the number of decimal places needed to write r exactly.  r must
+// be a decimal number so its denominator divides a power of ten.
+func decimalPlaces(r *big.Rat) (n int) {
+	p, ten, m := big.NewInt(1), big.NewInt(10), new(big.Int)
+
+	for m.Mod(p, r.Denom()).Sign() != 0 {
+		p.Mul(p, ten)
+		n++
+	}
+
+	return n
+}
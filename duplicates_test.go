@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	in := `date time, e (mm), error (mm)
+2012-07-31T12:01:04.000000Z,1.0,0.3
+2012-08-01T11:58:56.000000Z,2.0,0.5
+2012-07-31T12:01:04.000000Z,2.5,0.1
+2012-07-31T12:01:04Z,1.1,0.2
+`
+
+	expected := []struct {
+		p      dupPolicy
+		vs, es string
+	}{
+		{p: keepFirst, vs: "1.0", es: "0.3"},
+		{p: keepLast, vs: "1.1", es: "0.2"},
+		{p: keepSmallestError, vs: "2.5", es: "0.1"},
+		{p: averageDuplicates, vs: "1.5333333", es: "0.2"},
+	}
+
+	for _, e := range expected {
+		o := observation{policy: e.p}
+
+		if err := o.read(strings.NewReader(in)); err != nil {
+			t.Fatalf("%s: %s", e.p, err)
+		}
+
+		if len(o.obs) != 2 {
+			t.Fatalf("%s: expected 2 observations got %d", e.p, len(o.obs))
+		}
+
+		if o.obs[0].vs != e.vs || o.obs[0].es != e.es {
+			t.Errorf("%s: expected %s, %s got %s, %s", e.p, e.vs, e.es, o.obs[0].vs, o.obs[0].es)
+		}
+
+		if len(o.resolved) != 1 || !reflect.DeepEqual(o.resolved[0].rows, []int{1, 3, 4}) {
+			t.Fatalf("%s: expected rows 1, 3, and 4 resolved got %v", e.p, o.resolved)
+		}
+
+		if o.resolved[0].kept.vs != e.vs || o.resolved[0].kept.es != e.es {
+			t.Errorf("%s: expected resolved %s, %s got %s, %s", e.p, e.vs, e.es, o.resolved[0].kept.vs, o.resolved[0].kept.es)
+		}
+	}
+
+	o := observation{}
+
+	if err := o.read(strings.NewReader(in)); err == nil {
+		t.Error("expected duplicates to be rejected by default")
+	}
+}
+
+func TestMean(t *testing.T) {
+	in := []struct {
+		s        []string
+		expected string
+	}{
+		{s: []string{"1", "2"}, expected: "1.5"},
+		{s: []string{"-0.1", "0.1"}, expected: "0"},
+		{s: []string{"1E-30", "3E-30"}, expected: "0.000000000000000000000000000002"},
+		{s: []string{"123456789012345678901234567890.1", "123456789012345678901234567890.3"}, expected: "123456789012345678901234567890.2"},
+		{s: []string{"1", "1", "2"}, expected: "1.333333"},
+	}
+
+	for _, v := range in {
+		m, err := mean(v.s)
+		if err != nil {
+			t.Errorf("mean of %v: %s", v.s, err)
+		}
+
+		if m != v.expected {
+			t.Errorf("mean of %v expected %s got %s", v.s, v.expected, m)
+		}
+	}
+
+	// big.Rat can't parse very large exponents.
+	if _, err := mean([]string{"1e99999999", "2"}); err == nil {
+		t.Error("expected an error for an exponent big.Rat can't parse")
+	}
+}
+
+func TestAverageExtremeExponent(t *testing.T) {
+	in := []struct {
+		id, value string
+		valid     bool
+	}{
+		// the exponent is rejected when it is read, before the duplicates are averaged.
+		{id: "beyond NUMERIC", value: "1e99999999"},
+		{id: "largest exponent", value: "1e1000", valid: true},
+		{id: "smallest exponent", value: "1e-1000", valid: true},
+	}
+
+	for _, v := range in {
+		o := observation{policy: averageDuplicates}
+
+		err := o.read(strings.NewReader("date time, e (mm), error (mm)\n2012-07-31T12:01:04.000000Z," + v.value + ",1\n2012-07-31T12:01:04.000000Z,2,1\n"))
+		if v.valid && err != nil {
+			t.Errorf("%s: expected no error got %s", v.id, err)
+		}
+		if !v.valid && err == nil {
+			t.Errorf("%s: expected an error", v.id)
+		}
+	}
+}
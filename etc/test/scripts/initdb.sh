@@ -39,5 +39,6 @@ psql --host=127.0.0.1 -d fits --username=$db_user -c 'create extension postgis;'
 
 psql --host=127.0.0.1 --quiet --username=$db_user --dbname=fits --file=${ddl_dir}/fits-create.ddl
 psql --host=127.0.0.1 --quiet --username=$db_user --dbname=fits --file=${ddl_dir}/fits-functions.ddl
+psql --host=127.0.0.1 --quiet --username=$db_user --dbname=fits --file=${ddl_dir}/fits-loader-create.ddl
 psql --host=127.0.0.1 --quiet --username=$db_user --dbname=fits --file=${ddl_dir}/user-permissions.ddl
 psql --host=127.0.0.1 --quiet --username=$db_user --dbname=fits --file=${ddl_dir}/fits-test-data.ddl
\ No newline at end of file
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportTime is the format observation times are exported in.
+const exportTime = "2006-01-02T15:04:05.000000Z07:00"
+
+var (
+	exportSite, exportType, exportMethod, exportSample string
+	exportStart, exportEnd                             time.Time
+	exportDir                                          string
+)
+
+// exportFlags adds the flags for the export command.
+func exportFlags() {
+	flag.StringVar(&exportSite, "site", "", "optional siteID to export e.g., VGT2.")
+	flag.StringVar(&exportType, "type", "", "optional typeID to export e.g., e.")
+	flag.StringVar(&exportMethod, "method", "", "optional methodID to export e.g., bernese5.")
+	flag.StringVar(&exportSample, "sample", "", "optional sampleID to export e.g., none.")
+	flag.Func("start", "optional RFC3339 time to export observations from.", parseTime(&exportStart))
+	flag.Func("end", "optional RFC3339 time to export observations to.", parseTime(&exportEnd))
+	flag.StringVar(&exportDir, "output-dir", ".", "the directory to write the observation and source files to.")
+}
+
+// exportSeries is a series in the DB to be exported as an observation and source file.
+type exportSeries struct {
+	key  seriesKey
+	src  source
+	unit string
+}
+
+// export writes an observation and source file, in the format they are loaded from, to exportDir
+// for each series in the DB that matches the filters.  It returns the exit code.
+func export() int {
+	if !exportStart.IsZero() && !exportEnd.IsZero() && exportEnd.Before(exportStart) {
+		fatal("--end is before --start")
+	}
+
+	if err := config.initDB(); err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	series, err := exportList()
+	if err != nil {
+		log.Printf("ERROR - finding series to export: %s", err)
+		return exitFailed
+	}
+
+	if len(series) == 0 {
+		log.Print("found no series to export")
+		return exitOK
+	}
+
+	// each series is exported to SITE_type so the files for two methods or samples would collide.
+	seen := make(map[string]string)
+
+	for _, e := range series {
+		name, s := e.name(), e.src.seriesName()
+		if o, ok := seen[name]; ok {
+			log.Printf("ERROR - %s and %s would both be exported to %s, use --method or --sample", o, s, name)
+			return exitConfig
+		}
+		seen[name] = s
+	}
+
+	code := exitOK
+
+	for _, e := range series {
+		if err := e.export(exportDir); err != nil {
+			log.Printf("ERROR - exporting %s: %s", e.src.seriesName(), err)
+			code = exitFailed
+		}
+	}
+
+	return code
+}
+
+// exportList returns the series in the DB that match the filters and have observations
+// between exportStart and exportEnd.
+func exportList() ([]exportSeries, error) {
+	rows, err := db.Query(`SELECT o.sitepk, o.typepk, o.methodpk, o.samplepk,
+				s.siteID, s.name, ST_X(s.location::geometry), ST_Y(s.location::geometry), s.height, s.ground_relationship,
+				t.typeID, u.symbol, m.methodID, sa.sampleID, sy.systemID
+				FROM (SELECT DISTINCT sitepk, typepk, methodpk, samplepk FROM fits.observation
+					WHERE ($5::timestamptz IS NULL OR time >= $5) AND ($6::timestamptz IS NULL OR time <= $6)) o
+				JOIN fits.site s USING (sitepk)
+				JOIN fits.type t USING (typepk)
+				JOIN fits.unit u USING (unitpk)
+				JOIN fits.method m USING (methodpk)
+				JOIN fits.sample sa USING (samplepk)
+				JOIN fits.system sy USING (systempk)
+				WHERE ($1 = '' OR s.siteID = $1) AND ($2 = '' OR t.typeID = $2)
+				AND ($3 = '' OR m.methodID = $3) AND ($4 = '' OR sa.sampleID = $4)
+				ORDER BY s.siteID, t.typeID, m.methodID, sa.sampleID`,
+		exportSite, exportType, exportMethod, exportSample, nullTime(exportStart), nullTime(exportEnd))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []exportSeries
+
+	for rows.Next() {
+		e := exportSeries{src: source{Type: "Point", Coordinates: make([]float64, 2)}}
+		p := &e.src.Properties
+
+		err = rows.Scan(&e.key.sitePK, &e.key.typePK, &e.key.methodPK, &e.key.samplePK,
+			&p.SiteID, &p.Name, &e.src.Coordinates[0], &e.src.Coordinates[1], &p.Height, &p.GroundRelationship,
+			&p.TypeID, &e.unit, &p.MethodID, &p.SampleID, &p.SystemID)
+		if err != nil {
+			return nil, err
+		}
+
+		series = append(series, e)
+	}
+
+	return series, rows.Err()
+}
+
+// nullTime returns nil for the zero time so it is NULL in a query.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// name returns the base name of the files e is exported to e.g., VGT2_e.
+func (e exportSeries) name() string {
+	return e.src.Properties.SiteID + "_" + e.src.Properties.TypeID
+}
+
+// export writes the observation and source files for e to dir.
+func (e exportSeries) export(dir string) error {
+	name := filepath.Join(dir, e.name()+".csv")
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	n, err := e.writeObs(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if f, err = os.Create(sourceFileName(name)); err != nil {
+		return err
+	}
+
+	// the window is set so the export can be restored by loading it with --sync-window.
+	s := e.src
+	if !exportStart.IsZero() {
+		s.Properties.WindowStart = &exportStart
+	}
+	if !exportEnd.IsZero() {
+		s.Properties.WindowEnd = &exportEnd
+	}
+
+	if err = writeSource(f, s); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("exported %d observations for %s to %s", n, e.src.seriesName(), name)
+
+	return nil
+}
+
+// writeObs writes the observations for e between exportStart and exportEnd to w in the observation
+// file format.  Values and errors are written exactly as they are in the DB.
+func (e exportSeries) writeObs(w io.Writer) (n int, err error) {
+	rows, err := db.Query(`SELECT time, value::text, error::text FROM fits.observation
+				WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4
+				AND ($5::timestamptz IS NULL OR time >= $5) AND ($6::timestamptz IS NULL OR time <= $6)
+				ORDER BY time`,
+		e.key.sitePK, e.key.typePK, e.key.methodPK, e.key.samplePK, nullTime(exportStart), nullTime(exportEnd))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	return writeObsRows(w, e.src.Properties.TypeID, e.unit, rows)
+}
+
+// writeObsRows writes rows to w in the observation file format.  rows must select the time and the
+// value and error as text.
+func writeObsRows(w io.Writer, typeID, unit string, rows *sql.Rows) (n int, err error) {
+	c := csv.NewWriter(w)
+
+	if err = c.Write([]string{"date time", fmt.Sprintf("%s (%s)", typeID, unit), fmt.Sprintf("error (%s)", unit)}); err != nil {
+		return 0, err
+	}
+
+	var t time.Time
+	var v, e string
+
+	for rows.Next() {
+		if err = rows.Scan(&t, &v, &e); err != nil {
+			return n, err
+		}
+
+		if err = c.Write([]string{t.UTC().Format(exportTime), v, e}); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if err = rows.Err(); err != nil {
+		return n, err
+	}
+
+	c.Flush()
+
+	return n, c.Error()
+}
+
+// writeSource writes s to w in the source file format.
+func writeSource(w io.Writer, s source) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportSource(t *testing.T) {
+	e := exportSeries{src: source{
+		Type:        "Point",
+		Coordinates: []float64{175.673170826, -39.108617051},
+		Properties: sourceProperties{
+			SiteID:             "VGT2",
+			Name:               "Te Maari 2",
+			TypeID:             "e",
+			MethodID:           "bernese5",
+			SampleID:           "none",
+			SystemID:           "none",
+			Height:             -999.9,
+			GroundRelationship: -999.9,
+		},
+	}}
+
+	if e.name() != "VGT2_e" {
+		t.Errorf("expected name VGT2_e got %s", e.name())
+	}
+
+	var b bytes.Buffer
+
+	if err := writeSource(&b, e.src); err != nil {
+		t.Fatal(err)
+	}
+
+	var s source
+
+	if err := s.unmarshall(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s, e.src) {
+		t.Errorf("expected %+v got %+v", e.src, s)
+	}
+}
+
+func TestExport(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		exportSite, exportStart = "", time.Time{}
+	}()
+
+	exportSite = "VGT2"
+	exportStart = time.Date(2012, 8, 3, 0, 0, 0, 0, time.UTC)
+
+	series, err := exportList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series got %d", len(series))
+	}
+
+	dir := t.TempDir()
+
+	if err = series[0].export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "VGT2_e.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := `date time,e (mm),error (mm)
+2012-08-03T11:58:56.000000Z,-1.95,3.91
+2012-08-04T12:01:04.000000Z,4.33,3.39
+2012-08-05T11:58:56.000000Z,0.18,3.75
+2012-08-06T12:01:04.000000Z,4.61,4.64
+`
+
+	if string(b) != e {
+		t.Errorf("expected:\n%s\ngot:\n%s", e, string(b))
+	}
+
+	x := data{
+		sourceFile:      filepath.Join(dir, "VGT2_e.json"),
+		observationFile: filepath.Join(dir, "VGT2_e.csv"),
+	}
+
+	if err = x.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// --start is written as the window start so the export can be restored with --sync-window.
+	if x.Properties.WindowStart == nil || !x.Properties.WindowStart.Equal(exportStart) || x.Properties.WindowEnd != nil {
+		t.Errorf("expected exported window start %s and no end got %v, %v", exportStart, x.Properties.WindowStart, x.Properties.WindowEnd)
+	}
+
+	x.Properties.WindowStart = nil
+
+	if x.Properties != d.Properties {
+		t.Errorf("expected exported properties %+v got %+v", d.Properties, x.Properties)
+	}
+
+	if !reflect.DeepEqual(x.Coordinates, d.Coordinates) {
+		t.Errorf("expected exported coordinates %v got %v", d.Coordinates, x.Coordinates)
+	}
+}
@@ -16,7 +16,4 @@ EOT
 
 echo ${FITSCONFIG} > fits-loader.json
 
-while true; do
-  ./sqs-process.sh
-  sleep 1
-done
\ No newline at end of file
+exec ./fits-loader serve-sqs --queue-url "${SQS_QUEUE_URL}" --dead-letter-url "${SQS_DEAD_LETTER_URL}"
@@ -3,12 +3,17 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"log/syslog"
 	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -25,33 +30,130 @@ type DataBase struct {
 // version 1.x no longer uses the network code in the DB.
 const vers = "1.0"
 
+// exit codes.
+const (
+	exitOK     = 0 // all files were processed.
+	exitFailed = 1 // one or more files failed.
+	exitConfig = 2 // there was a problem with the config or the DB.
+)
+
 var (
-	config                                       = initConfig()
-	db                                           *sql.DB
-	dataDir                                      string
-	configFile                                   string
-	dryRun, deleteFirst, slog, version, locValid bool
+	config                                                   Config
+	db                                                       *sql.DB
+	dataDir, archivePath                                     string
+	configFile, reportFile                                   string
+	dryRun, deleteFirst, syncWindow, slog, version, locValid bool
+	failFast, useLedger                                      bool
+	workers                                                  int
+	windowStart, windowEnd                                   time.Time
 )
 
-func initConfig() Config {
+// initConfig parses the command line flags for cmd and loads the config.
+func initConfig(cmd string) Config {
 	flag.StringVar(&dataDir, "data-dir", "", "path to directory of observation and source files.")
+	flag.StringVar(&archivePath, "archive", "", "path to a tar.gz archive of observation and source files, - to read from stdin.")
 	flag.StringVar(&configFile, "config-file", "fits-loader.json", "optional file to load the config from.")
+	flag.StringVar(&reportFile, "report", "", "optional file to write a JSON report of the files processed to.")
 	flag.BoolVar(&slog, "syslog", false, "output log messages to syslog instead of stdout.")
 	flag.BoolVar(&deleteFirst, "delete-first", false, "sync the FITS DB data with the information in each observation file.")
+	flag.BoolVar(&syncWindow, "sync-window", false, "sync the FITS DB data with the information in each observation file only within the time window covered by the file.")
+	flag.Func("window-start", "optional RFC3339 start of the sync window, overrides the file and source.", parseTime(&windowStart))
+	flag.Func("window-end", "optional RFC3339 end of the sync window, overrides the file and source.", parseTime(&windowEnd))
 	flag.BoolVar(&dryRun, "dry-run", false, "data is parsed and validated but not loaded to the DB.  A DB connection is needed for validation.")
 	flag.BoolVar(&locValid, "local-validate", false, "data is parsed and validated without a connection to the DB.")
+	flag.IntVar(&batchSize, "batch-size", 1000, "the number of observations read from each observation file and copied to the DB at a time.")
+	flag.DurationVar(&timeResolution, "time-resolution", time.Microsecond, "the resolution observation times are rounded to before checking for duplicates e.g., 1s.")
+	flag.BoolVar(&truncateTime, "truncate-time", false, "truncate observation times to --time-resolution instead of rounding.")
+	flag.StringVar(&duplicates, "duplicates", "", "optional policy for observations at the same time: reject, first, last, smallest-error, or average.  Overrides the source file.")
+	flag.IntVar(&maxErrors, "max-errors", 100, "the number of validation errors to collect from each observation file, 0 for no limit.")
+	flag.Float64Var(&maxDeletePercent, "max-delete-percent", 0, "refuse a sync that would remove more than this percentage of the existing observations, 0 for no limit.")
+	flag.Float64Var(&minSpanPercent, "min-span-percent", 0, "refuse a sync when the file covers less than this percentage of the time span of the existing observations, 0 for no limit.")
+	flag.Int64Var(&maxRowDrop, "max-row-drop", 0, "refuse a sync that would drop the number of observations by more than this, 0 for no limit.")
+	flag.BoolVar(&forceSync, "force", false, "sync even if a --max-delete-percent, --min-span-percent, or --max-row-drop threshold is tripped.")
+	flag.BoolVar(&backupDB, "backup-db", false, "copy the observations removed by a sync to fits.loader_backup, keyed by the load ID.")
+	flag.StringVar(&backupDir, "backup-dir", "", "optional directory to write the observations removed by a sync to, in a sub directory for the load ID.")
+	flag.BoolVar(&provenance, "provenance", true, "record each load and the outcome for each file in fits.loader_load and fits.loader_load_file.  Use --provenance=false to not record.")
+	flag.BoolVar(&useLedger, "ledger", false, "skip files already loaded in the same mode and record loaded files in fits.loader_ledger.")
+	flag.BoolVar(&atomicLoad, "atomic", false, "validate every file first then save them all in a single transaction.  Nothing is saved if any file fails.")
+	flag.BoolVar(&stagingLoad, "staging", false, "load every file into a staging copy of the observations and only publish them if they pass verification.  Implies --atomic.")
+	flag.BoolVar(&verifyOnly, "verify-only", false, "load into the staging table, log the verification of each series, then roll back without publishing.  Implies --staging.")
+	flag.Float64Var(&valueMargin, "verify-value-margin", 1, "how far staged values may be outside the live values as a multiple of the live range, negative to not check.")
+	flag.IntVar(&workers, "workers", 1, "the number of files to validate and load at the same time.  Loading is limited by the DB pool size.")
+	flag.BoolVar(&failFast, "fail-fast", false, "stop processing at the first file with an error.")
 	flag.BoolVar(&version, "version", false, "prints the version and exits.")
+
+	switch cmd {
+	case "":
+	case "serve-sqs":
+		sqsFlags()
+	case "pack":
+		packFlags()
+	case "plan":
+		planFlags()
+	case "apply":
+	case "diff":
+	case "export":
+		exportFlags()
+	case "history":
+		historyFlags()
+	default:
+		fatal(fmt.Sprintf("unknown command %s", cmd))
+	}
+
 	flag.Parse()
 
+	// pack never uses the DB.
+	if cmd == "pack" {
+		locValid = true
+	}
+
+	if verifyOnly {
+		stagingLoad = true
+	}
+
 	if version {
 		fmt.Printf("fits-loader version %s\n", vers)
-		os.Exit(1)
+		os.Exit(exitOK)
 	}
 
 	if locValid {
 		fmt.Println("Validating without DB connection")
 	}
 
+	if dataDir != "" && archivePath != "" {
+		fatal("only one of --data-dir or --archive can be used")
+	}
+
+	if workers < 1 {
+		fatal("--workers must be at least 1")
+	}
+
+	if batchSize < 1 {
+		fatal("--batch-size must be at least 1")
+	}
+
+	if timeResolution < time.Microsecond || timeResolution%time.Microsecond != 0 {
+		fatal("--time-resolution must be a whole number of microseconds")
+	}
+
+	if duplicates != "" {
+		if _, err := parseDupPolicy(duplicates); err != nil {
+			fatal(err)
+		}
+	}
+
+	if maxDeletePercent < 0 || minSpanPercent < 0 || maxRowDrop < 0 {
+		fatal("--max-delete-percent, --min-span-percent, and --max-row-drop can't be negative")
+	}
+
+	if deleteFirst && syncWindow {
+		fatal("only one of --delete-first or --sync-window can be used")
+	}
+
+	if !syncWindow && (!windowStart.IsZero() || !windowEnd.IsZero()) {
+		fatal("--window-start and --window-end need --sync-window")
+	}
+
 	if slog {
 		logwriter, err := syslog.New(syslog.LOG_NOTICE, "fits-loader")
 		if err == nil {
@@ -68,13 +170,13 @@ func initConfig() Config {
 		f, err := os.ReadFile(configFile)
 		if err != nil {
 			log.Printf("ERROR - problem loading %s - can't find any config.", configFile)
-			log.Fatal(err)
+			fatal(err)
 		}
 
 		err = json.Unmarshal(f, &c)
 		if err != nil {
 			log.Println("Problem parsing config file.")
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
@@ -82,21 +184,108 @@ func initConfig() Config {
 }
 
 func main() {
+	cmd := subCommand()
+	config = initConfig(cmd)
+
+	switch {
+	case cmd == "serve-sqs":
+		os.Exit(serveSQS())
+	case cmd == "pack":
+		os.Exit(pack())
+	case cmd == "plan":
+		os.Exit(makePlan())
+	case cmd == "apply":
+		os.Exit(applyPlan(flag.Arg(0)))
+	case cmd == "diff":
+		os.Exit(diffDataDir())
+	case cmd == "export":
+		os.Exit(export())
+	case cmd == "history":
+		os.Exit(history())
+	case archivePath != "":
+		os.Exit(loadArchive())
+	default:
+		os.Exit(loadDataDir())
+	}
+}
+
+// subCommand removes and returns the sub command from the command line.  It returns
+// an empty string if there is no sub command.
+func subCommand() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return ""
+	}
+
+	cmd := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	return cmd
+}
+
+// loadDataDir loads the files in dataDir and returns the exit code.
+func loadDataDir() int {
 	if dataDir == "" {
-		log.Fatal("please specify the data directory")
+		fatal("please specify the data directory")
+	}
+
+	log.Printf("searching for observation and source data in %s", dataDir)
+	proc, err := scan(dataDir)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	// the manifest is checked before connecting to the DB.
+	if err := checkManifest(os.DirFS(dataDir), proc); err != nil {
+		log.Printf("ERROR - rejecting %s: %s", dataDir, err)
+		return exitFailed
 	}
 
 	if !locValid {
 		if err := config.initDB(); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		defer db.Close()
 	}
 
-	log.Printf("searching for observation and source data in %s", dataDir)
-	files, err := os.ReadDir(dataDir)
+	log.Printf("found %d observation files to process", len(proc))
+
+	start := time.Now().UTC()
+	loadID = newLoadID(start)
+
+	startDir(start)
+
+	code := loadAll(proc)
+
+	if err := finish(start, proc); err != nil && code == exitOK {
+		code = exitFailed
+	}
+
+	finishLoad(proc)
+
+	return code
+}
+
+// startDir records the start of the load from dataDir.
+func startDir(start time.Time) {
+	if !recording() {
+		return
+	}
+
+	sum, err := fsChecksum(os.DirFS(dataDir))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR - checksum for load %s: %s", loadID, err)
+	}
+
+	startLoad(mode(), dataDir, sum, start)
+}
+
+// scan returns the observation files in dir along with their source files.  The load mode
+// for each is set from the command line.
+func scan(dir string) ([]data, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
 
 	var proc []data
@@ -104,49 +293,312 @@ func main() {
 	for _, f := range files {
 		info, err := f.Info()
 		if err != nil {
-			log.Fatalf("error getting file info for %s: %s", f.Name(), err.Error())
+			return nil, fmt.Errorf("error getting file info for %s: %s", f.Name(), err.Error())
 		}
-		if !f.IsDir() && strings.HasSuffix(f.Name(), `.csv`) && info.Size() > 0 {
-			meta := f.Name()
-			meta = strings.TrimSuffix(meta, `.csv`) + `.json`
-
-			if _, err := os.Stat(dataDir + "/" + meta); os.IsNotExist(err) {
-				log.Fatalf("found no json source file for %s", f.Name())
-			}
+		if !f.IsDir() && isObservationFile(f.Name(), info.Size()) {
 			proc = append(proc, data{
-				sourceFile:      dataDir + "/" + meta,
-				observationFile: dataDir + "/" + f.Name(),
+				sourceFile:      dir + "/" + sourceFileName(f.Name()),
+				observationFile: dir + "/" + f.Name(),
+				mode:            defaultMode(),
 			})
 		}
 	}
 
-	log.Printf("found %d observation files to process", len(proc))
+	return proc, nil
+}
 
-	for _, d := range proc {
-		log.Printf("reading and validating %s", d.observationFile)
-		if err := d.parseAndValidate(); err != nil {
-			log.Fatal(err)
-		}
+// isObservationFile returns true if name is a non empty observation file.
+func isObservationFile(name string, size int64) bool {
+	return strings.HasSuffix(name, `.csv`) && size > 0
+}
 
-		if !dryRun && !locValid {
-			log.Printf("saving site information from %s", d.sourceFile)
-			if err := d.saveSite(); err != nil {
-				log.Fatal(err)
-			}
+// sourceFileName returns the name of the source file for the observation file name.
+func sourceFileName(name string) string {
+	return strings.TrimSuffix(name, `.csv`) + `.json`
+}
+
+// loadAll processes each of proc in order.  It returns exitFailed if any file failed or
+// exitConfig if processing stopped because the DB is not available.
+func loadAll(proc []data) int {
+	if atomicLoad || stagingLoad {
+		return loadAtomic(proc)
+	}
 
-			log.Printf("saving observations from %s", d.observationFile)
+	if workers > 1 {
+		return loadParallel(proc)
+	}
 
-			if !deleteFirst {
-				if err := d.updateOrAdd(); err != nil {
-					log.Fatal(err)
-				}
-			} else {
-				if err := d.deleteThenSave(); err != nil {
-					log.Fatal(err)
+	code := exitOK
+
+	for i := range proc {
+		if err := process(&proc[i]); err != nil {
+			log.Printf("ERROR - processing %s: %s", proc[i].observationFile, err)
+			code = exitFailed
+
+			if failFast {
+				break
+			}
+
+			// there is no point carrying on if the DB has gone away.
+			if !locValid {
+				if err := db.Ping(); err != nil {
+					log.Printf("ERROR - DB not available: %s", err)
+					return exitConfig
 				}
 			}
 		}
+	}
+
+	return code
+}
 
+// process parses, validates, and loads the files for d according to the command line options
+// and d.mode.  The outcome is recorded in d.result.
+func process(d *data) error {
+	if err := validate(d); err != nil {
+		return err
+	}
+
+	return load(d)
+}
+
+// validate parses and validates the files for d.  The outcome is recorded in d.result.
+func validate(d *data) (err error) {
+	defer func() {
+		d.err = err
+	}()
+
+	if f, err := d.open(d.sourceFile); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("found no json source file for %s", d.observationFile)
+	} else if err == nil {
+		f.Close()
+	}
+
+	// observations are only kept in memory when they are not being saved.
+	d.streamed = !(dryRun || locValid)
+
+	log.Printf("reading and validating %s", d.observationFile)
+	if err = d.parseAndValidate(); err != nil {
+		var v *validationErrors
+		if (dryRun || locValid) && errors.As(err, &v) {
+			for _, e := range v.errs {
+				log.Printf("%s: %s", d.observationFile, e)
+			}
+			if v.truncated {
+				log.Printf("%s: stopped reading after %d errors", d.observationFile, len(v.errs))
+			}
+		}
+		return err
+	}
+
+	if d.mode == syncWindowMode {
+		if err = d.setWindow(windowStart, windowEnd); err != nil {
+			return err
+		}
+	}
+
+	if dryRun || locValid {
+		d.logResolved()
+	}
+
+	return nil
+}
+
+// load saves the files for d, which have been validated, to the DB unless this is a dry run or
+// local validation.  The outcome is recorded in d.result.
+func load(d *data) (err error) {
+	if dryRun || locValid {
+		return nil
+	}
+
+	defer func() {
+		d.err = err
+	}()
+
+	if skip, err := d.skip(nil); err != nil || skip {
+		return err
+	}
+
+	if err = withTx(d.save); err != nil {
+		d.unsave()
+		return err
+	}
+
+	d.logSaved()
+
+	return nil
+}
+
+// skip returns true, and marks d as skipped, if the ledger shows d has already been loaded.  The
+// ledger is read using tx if it is not nil.
+func (d *data) skip(tx *sql.Tx) (bool, error) {
+	if !useLedger {
+		return false, nil
+	}
+
+	done, t, err := d.loaded(tx)
+	if err != nil {
+		return false, err
+	}
+
+	if done {
+		log.Printf("skipping %s, it was loaded using %s at %s", d.observationFile, d.mode, t.Format(time.RFC3339))
+		d.skipped = true
+	}
+
+	return done, nil
+}
+
+// save saves the site and observations for d using tx according to d.mode and adds them to the ledger.
+func (d *data) save(tx *sql.Tx) (err error) {
+	log.Printf("saving site information from %s", d.sourceFile)
+	if err = d.saveSiteTx(tx); err != nil {
+		return err
+	}
+	d.siteSaved = true
+
+	return d.write(tx)
+}
+
+// write saves the observations for d using tx according to d.mode, adds them to the ledger, and records
+// them in the load.
+func (d *data) write(tx *sql.Tx) (err error) {
+	log.Printf("saving observations from %s", d.observationFile)
+
+	switch d.mode {
+	case deleteFirstMode, syncWindowMode:
+		err = d.deleteThenSaveTx(tx)
+	default:
+		err = d.updateOrAddTx(tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if useLedger {
+		if err = d.record(tx); err != nil {
+			return err
+		}
+	}
+
+	d.recordFile(tx)
+
+	return nil
+}
+
+// unsave resets the outcome of save for d after the transaction was rolled back.
+func (d *data) unsave() {
+	d.siteSaved = false
+	d.written, d.inserted, d.updated, d.deleted = 0, 0, 0, 0
+}
+
+// logSaved logs the observations saved for d once the transaction has been committed.
+func (d *data) logSaved() {
+	switch d.mode {
+	case deleteFirstMode:
+		log.Printf("deleted %d and inserted %d observations from %s", d.deleted, d.inserted, d.observationFile)
+	case syncWindowMode:
+		log.Printf("deleted %d and inserted %d observations from %s between %s and %s", d.deleted, d.inserted, d.observationFile,
+			d.window.start.Format(time.RFC3339Nano), d.window.end.Format(time.RFC3339Nano))
+	default:
+		log.Printf("inserted %d and updated %d observations from %s", d.inserted, d.updated, d.observationFile)
+	}
+
+	d.logResolved()
+}
+
+// logResolved logs the duplicate times resolved for d.  Each one is logged when validating.
+func (d *data) logResolved() {
+	if len(d.resolved) == 0 {
+		return
+	}
+
+	log.Printf("resolved %d duplicate times in %s using the %s policy", len(d.resolved), d.observationFile, d.policy)
+
+	if dryRun || locValid {
+		for _, r := range d.resolved {
+			log.Printf("%s: rows %v at %s resolved to value %s error %s", d.observationFile, r.rows, r.t.Format(time.RFC3339Nano), r.kept.vs, r.kept.es)
+		}
+	}
+}
+
+// defaultMode returns the load mode selected on the command line.
+func defaultMode() loadMode {
+	switch {
+	case deleteFirst:
+		return deleteFirstMode
+	case syncWindow:
+		return syncWindowMode
+	default:
+		return updateOrAddMode
+	}
+}
+
+// finish prints the summary for proc and writes the report if one was requested.
+func finish(start time.Time, proc []data) error {
+	summary(os.Stdout, proc)
+
+	if reportFile == "" {
+		return nil
+	}
+
+	if err := newReport(mode(), start, proc).write(reportFile); err != nil {
+		log.Printf("ERROR - writing report to %s: %s", reportFile, err)
+		return err
+	}
+
+	log.Printf("wrote report to %s", reportFile)
+
+	return nil
+}
+
+// mode returns the name of the mode selected on the command line.
+func mode() string {
+	switch {
+	case locValid:
+		return "local-validate"
+	case dryRun:
+		return "dry-run"
+	case verifyOnly:
+		return "verify-only"
+	default:
+		return defaultMode().String()
+	}
+}
+
+// summary writes a table of the outcome for each file in proc to w.
+func summary(w io.Writer, proc []data) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "FILE\tPARSED\tVALIDATED\tSKIPPED\tSITE SAVED\tROWS WRITTEN\tERROR")
+
+	var failed int
+
+	for _, d := range proc {
+		e := "-"
+		if d.err != nil {
+			e = d.err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%t\t%t\t%t\t%d\t%s\n", d.observationFile, d.parsed, d.validated, d.skipped, d.siteSaved, d.written, e)
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d files, %d failed\n", len(proc), failed)
+}
+
+// fatal logs v and exits with exitConfig.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitConfig)
+}
+
+// parseTime returns a flag.Func that parses an RFC3339 time into t.
+func parseTime(t *time.Time) func(string) error {
+	return func(s string) (err error) {
+		*t, err = time.Parse(time.RFC3339Nano, s)
+		return err
 	}
 }
 
@@ -177,5 +629,11 @@ func (c *Config) initDB() (err error) {
 		return err
 	}
 
+	if useLedger {
+		if err := initLedger(); err != nil {
+			return err
+		}
+	}
+
 	return err
 }
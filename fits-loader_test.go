@@ -1,15 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"log"
+	"os"
+	"strings"
+	"testing"
 )
 
-// setup starts a db connection and test server then inits an http client.
+// setup loads the config from fits-loader.json and starts a db connection.
 func setup() {
+	b, err := os.ReadFile("fits-loader.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config = Config{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		log.Fatal(err)
+	}
+
 	config.DataBase.SSLMode = "disable"
 	if err := config.initDB(); err != nil {
 		log.Fatal(err)
 	}
+
+	// files are only recorded in a load by tests that start one.
+	loadID, loadStarted = "", false
 }
 
 // teardown closes the db connection and  test server.  Defer this after setup() e.g.,
@@ -19,3 +38,24 @@ func setup() {
 func teardown() {
 	db.Close()
 }
+
+func TestSummary(t *testing.T) {
+	proc := []data{
+		{observationFile: "a.csv", result: result{parsed: true, validated: true, siteSaved: true, written: 7}},
+		{observationFile: "b.csv", result: result{parsed: true, err: errors.New("typeID.methodID not found")}},
+	}
+
+	var b bytes.Buffer
+
+	summary(&b, proc)
+
+	s := b.String()
+
+	if !strings.Contains(s, "typeID.methodID not found") {
+		t.Errorf("expected the error for b.csv in the summary:\n%s", s)
+	}
+
+	if !strings.HasSuffix(s, "2 files, 1 failed\n") {
+		t.Errorf("expected file counts at the end of the summary:\n%s", s)
+	}
+}
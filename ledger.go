@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ledgerCheck *sql.Stmt
+	ledgerAdd   *sql.Stmt
+)
+
+// initLedger should be called after the db is available.  It needs the fits.loader_ledger table.
+func initLedger() (err error) {
+	// hash, mode
+	ledgerCheck, err = db.Prepare(`SELECT loaded FROM fits.loader_ledger WHERE hash = $1 AND mode = $2`)
+	if err != nil {
+		return err
+	}
+
+	ledgerAdd, err = db.Prepare(`INSERT INTO fits.loader_ledger(hash, mode, observation_file, siteID, typeID, methodID, sampleID, systemID, rows, loaded)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+					ON CONFLICT (hash, mode) DO UPDATE SET observation_file = EXCLUDED.observation_file, rows = EXCLUDED.rows, loaded = EXCLUDED.loaded`)
+
+	return err
+}
+
+// contentHash returns the SHA-256 of the source and observation files for d.  For a windowed
+// sync the window is included so the same file synced over a different window has a different hash.
+// The duplicates policy and the time resolution are included when they can change the observations saved.
+func (d *data) contentHash() (string, error) {
+	h := sha256.New()
+
+	for _, n := range []string{d.sourceFile, d.observationFile} {
+		f, err := d.open(n)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+
+	if d.policy != rejectDuplicates {
+		h.Write([]byte(d.policy.String() + "/"))
+	}
+
+	if timeResolution != time.Microsecond || truncateTime {
+		h.Write([]byte(fmt.Sprintf("%s/%t/", timeResolution, truncateTime)))
+	}
+
+	if d.mode == syncWindowMode {
+		h.Write([]byte(d.window.start.Format(time.RFC3339Nano) + "/" + d.window.end.Format(time.RFC3339Nano)))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loaded returns true if the ledger shows the files for d have already been loaded using d.mode.
+// The ledger is read using tx if it is not nil.
+func (d *data) loaded(tx *sql.Tx) (bool, time.Time, error) {
+	hash, err := d.contentHash()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	stmt := ledgerCheck
+	if tx != nil {
+		stmt = tx.Stmt(ledgerCheck)
+		defer stmt.Close()
+	}
+
+	var t time.Time
+
+	err = stmt.QueryRow(hash, d.mode.String()).Scan(&t)
+	switch err {
+	case nil:
+		return true, t, nil
+	case sql.ErrNoRows:
+		return false, t, nil
+	default:
+		return false, t, err
+	}
+}
+
+// record adds the files for d to the ledger using tx.
+func (d *data) record(tx *sql.Tx) error {
+	hash, err := d.contentHash()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(ledgerAdd).Exec(
+		hash,
+		d.mode.String(),
+		d.observationFile,
+		d.Properties.SiteID,
+		d.Properties.TypeID,
+		d.Properties.MethodID,
+		d.Properties.SampleID,
+		d.Properties.SystemID,
+		d.written,
+		time.Now().UTC())
+
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestContentHash(t *testing.T) {
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	h, err := d.contentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/errors/VGT2_e_dups.csv",
+	}
+
+	g, err := e.contentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h == g {
+		t.Error("expected a different hash for different observation files")
+	}
+
+	// the sync window is part of the hash.
+	d.mode = syncWindowMode
+	d.window = window{start: time.Date(2012, 7, 31, 0, 0, 0, 0, time.UTC), end: time.Date(2012, 8, 7, 0, 0, 0, 0, time.UTC)}
+
+	if g, err = d.contentHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h == g {
+		t.Error("expected a different hash for a sync window")
+	}
+
+	// the time resolution is part of the hash.
+	defer func() { timeResolution, truncateTime = time.Microsecond, false }()
+
+	h = g
+	timeResolution = time.Second
+
+	if g, err = d.contentHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h == g {
+		t.Error("expected a different hash for a different time resolution")
+	}
+
+	h = g
+	truncateTime = true
+
+	if g, err = d.contentHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h == g {
+		t.Error("expected a different hash when truncating times")
+	}
+}
+
+func TestLedger(t *testing.T) {
+	l := useLedger
+	defer func() { useLedger = l }()
+	useLedger = true
+
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	if err := db.QueryRow("truncate fits.loader_ledger").Scan(); err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := process(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.skipped || d.written != 7 {
+		t.Errorf("expected 7 observations written got %d skipped %t", d.written, d.skipped)
+	}
+
+	// the same files again are skipped.
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := process(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.skipped || d.written != 0 {
+		t.Errorf("expected the files to be skipped got %d written skipped %t", d.written, d.skipped)
+	}
+
+	// the same files in a different mode are loaded.
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+		mode:            deleteFirstMode,
+	}
+
+	if err := process(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.skipped || d.written != 7 {
+		t.Errorf("expected 7 observations written got %d skipped %t", d.written, d.skipped)
+	}
+
+	// an atomic load reads the ledger in its transaction so it doesn't wait for a second connection.
+	db.SetMaxOpenConns(1)
+
+	proc := []data{{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+		mode:            deleteFirstMode,
+	}}
+
+	if c := loadAtomic(proc); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if !proc[0].skipped {
+		t.Error("expected the files to be skipped in an atomic load")
+	}
+}
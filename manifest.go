@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+)
+
+// manifestFile is the optional manifest in a data directory or archive.
+const manifestFile = "manifest.json"
+
+// manifest declares the contents of a bundle of observation and source files.  Every observation
+// and source file in the bundle must be listed with its SHA-256 checksum.
+type manifest struct {
+	Producer string          `json:"producer"`
+	Mode     string          `json:"mode,omitempty"`
+	Files    []manifestEntry `json:"files"`
+}
+
+// manifestEntry is a file in a manifest.  Mode is only used for observation files and overrides
+// the manifest mode.
+type manifestEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// parseMode returns the loadMode called s.
+func parseMode(s string) (loadMode, error) {
+	for _, m := range []loadMode{updateOrAddMode, deleteFirstMode, syncWindowMode} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+
+	return updateOrAddMode, fmt.Errorf("unknown load mode %q", s)
+}
+
+// readManifest reads the manifest from fsys.  It returns nil if there is no manifest.
+func readManifest(fsys fs.FS) (*manifest, error) {
+	b, err := fs.ReadFile(fsys, manifestFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", manifestFile, err)
+	}
+
+	return &m, nil
+}
+
+// verify checks that the observation and source files in fsys are exactly those listed in m,
+// that their checksums match, that every listed observation file has a listed source file, and
+// that the modes are valid.
+func (m *manifest) verify(fsys fs.FS) error {
+	if m.Mode != "" {
+		if _, err := parseMode(m.Mode); err != nil {
+			return err
+		}
+	}
+
+	listed := make(map[string]bool)
+
+	for _, f := range m.Files {
+		if listed[f.Name] {
+			return fmt.Errorf("%s is listed more than once in %s", f.Name, manifestFile)
+		}
+		listed[f.Name] = true
+
+		if f.Mode != "" {
+			if _, err := parseMode(f.Mode); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+
+		b, err := fs.ReadFile(fsys, f.Name)
+		if err != nil {
+			return fmt.Errorf("missing file %s listed in %s: %w", f.Name, manifestFile, err)
+		}
+
+		sum := sha256.Sum256(b)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), f.SHA256) {
+			return fmt.Errorf("checksum mismatch for %s", f.Name)
+		}
+	}
+
+	for _, f := range m.Files {
+		if strings.HasSuffix(f.Name, `.csv`) && !listed[sourceFileName(f.Name)] {
+			return fmt.Errorf("no source file listed in %s for %s", manifestFile, f.Name)
+		}
+	}
+
+	e, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	for _, f := range e {
+		n := f.Name()
+		if f.IsDir() || !(strings.HasSuffix(n, `.csv`) || strings.HasSuffix(n, `.json`)) || n == manifestFile {
+			continue
+		}
+
+		if !listed[n] {
+			return fmt.Errorf("%s is not listed in %s", n, manifestFile)
+		}
+	}
+
+	return nil
+}
+
+// apply sets the load mode for each of proc from m.
+func (m *manifest) apply(proc []data) {
+	modes := make(map[string]string)
+	for _, f := range m.Files {
+		modes[f.Name] = f.Mode
+	}
+
+	for i := range proc {
+		s := modes[path.Base(proc[i].observationFile)]
+		if s == "" {
+			s = m.Mode
+		}
+		if s == "" {
+			continue
+		}
+
+		// modes have been checked by verify.
+		proc[i].mode, _ = parseMode(s)
+	}
+}
+
+// checkManifest verifies the manifest in fsys, if there is one, and applies it to proc.
+func checkManifest(fsys fs.FS, proc []data) error {
+	m, err := readManifest(fsys)
+	if err != nil {
+		return err
+	}
+
+	if m == nil {
+		return nil
+	}
+
+	if err = m.verify(fsys); err != nil {
+		return err
+	}
+
+	log.Printf("verified %s from %s with %d files", manifestFile, m.Producer, len(m.Files))
+
+	m.apply(proc)
+
+	return nil
+}
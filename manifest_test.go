@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	b := bundle{}
+
+	for _, n := range []string{"VGT2_e.csv", "VGT2_e.json"} {
+		c, err := os.ReadFile("etc/" + n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[n] = c
+	}
+
+	sum := func(n string) string {
+		s := sha256.Sum256(b[n])
+		return hex.EncodeToString(s[:])
+	}
+
+	m := manifest{
+		Producer: "test",
+		Mode:     "delete-first",
+		Files: []manifestEntry{
+			{Name: "VGT2_e.csv", SHA256: sum("VGT2_e.csv")},
+			{Name: "VGT2_e.json", SHA256: sum("VGT2_e.json")},
+		},
+	}
+
+	write := func() {
+		j, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[manifestFile] = j
+	}
+
+	write()
+
+	proc := scanArchive(b)
+
+	if err := checkManifest(b, proc); err != nil {
+		t.Fatal(err)
+	}
+
+	if proc[0].mode != deleteFirstMode {
+		t.Errorf("expected mode delete-first from the manifest got %s", proc[0].mode)
+	}
+
+	// the file mode overrides the manifest mode.
+	m.Files[0].Mode = "sync-window"
+	write()
+
+	if err := checkManifest(b, proc); err != nil {
+		t.Fatal(err)
+	}
+
+	if proc[0].mode != syncWindowMode {
+		t.Errorf("expected mode sync-window from the manifest got %s", proc[0].mode)
+	}
+
+	// tampered file.
+	b["VGT2_e.csv"] = append(b["VGT2_e.csv"], []byte("2012-08-07T12:01:04.000000Z,4.61,4.64\n")...)
+
+	if err := checkManifest(b, proc); err == nil {
+		t.Error("expected an error for a checksum mismatch")
+	}
+
+	m.Files[0].SHA256 = sum("VGT2_e.csv")
+	write()
+
+	if err := checkManifest(b, proc); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file that is not listed.
+	b["VGT2_u.csv"] = b["VGT2_e.csv"]
+
+	if err := checkManifest(b, proc); err == nil {
+		t.Error("expected an error for a file not in the manifest")
+	}
+
+	delete(b, "VGT2_u.csv")
+
+	// a listed file that is missing.
+	m.Files = append(m.Files, manifestEntry{Name: "VGT2_n.csv", SHA256: sum("VGT2_e.csv")})
+	write()
+
+	if err := checkManifest(b, proc); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// a listed observation file without a source file.
+	b["VGT2_n.csv"] = b["VGT2_e.csv"]
+
+	if err := checkManifest(b, proc); err == nil {
+		t.Error("expected an error for an observation file without a source file")
+	}
+
+	m.Files = m.Files[:2]
+	delete(b, "VGT2_n.csv")
+
+	m.Mode = "replace"
+	write()
+
+	if err := checkManifest(b, proc); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+
+	// no manifest.
+	delete(b, manifestFile)
+
+	if err := checkManifest(b, proc); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,26 +2,246 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"math"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type obs struct {
 	t    time.Time
 	v, e float64
+	// ts, vs, and es are the time, value, and error as written in the observation file.  The value
+	// and error are saved to the DB so the decimal is stored exactly.
+	ts, vs, es string
+	// row is the row in the observation file, counting from 1 for the first line after the header.
+	row int
+}
+
+// decimal matches the number formats that can be stored exactly in a NUMERIC column.  The
+// mantissa and the exponent are sub matches.
+var decimal = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE]([+-]?[0-9]+))?$`)
+
+const (
+	// maxExponent is the largest exponent, plus or minus, in NUMERIC input for all Postgres versions.
+	maxExponent = 1000
+	// maxIntDigits and maxFracDigits are the most digits a NUMERIC can have before and after
+	// the decimal point.
+	maxIntDigits  = 131072
+	maxFracDigits = 16383
+)
+
+// checkDecimal returns why s can't be stored exactly in a NUMERIC column or an empty string if it can.
+func checkDecimal(s string) string {
+	m := decimal.FindStringSubmatch(s)
+	if m == nil {
+		return "is not a decimal number"
+	}
+
+	var exp int
+	if m[2] != "" {
+		var err error
+		if exp, err = strconv.Atoi(m[2]); err != nil || exp > maxExponent || exp < -maxExponent {
+			return fmt.Sprintf("has an exponent outside ±%d", maxExponent)
+		}
+	}
+
+	i, f, _ := strings.Cut(m[1], ".")
+
+	if n := len(strings.TrimLeft(i, "0")) + exp; n > maxIntDigits {
+		return fmt.Sprintf("has more than %d digits before the decimal point", maxIntDigits)
+	}
+
+	if n := len(f) - exp; n > maxFracDigits {
+		return fmt.Sprintf("has more than %d digits after the decimal point", maxFracDigits)
+	}
+
+	return ""
+}
+
+// parseDecimal returns the float64 nearest to s, which must pass checkDecimal.  It is only used to
+// compare observations.  Numbers beyond the range of a float64 are valid, they are stored exactly
+// in the DB, and are returned as ±Inf or 0.
+func parseDecimal(s string) float64 {
+	// the only possible error is a range error, for which f is still the nearest float64.
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
 }
 
 type observation struct {
 	obs []obs
+	// policy is how rows with the same time are resolved.
+	policy dupPolicy
+	// resolved is every duplicate time resolved using policy, in the order first seen.
+	resolved []duplicate
+	// streamed is true if the observations were checked with scan and not kept in obs.  n, first,
+	// and last describe them instead.
+	streamed    bool
+	n           int
+	first, last time.Time
+}
+
+// count returns the number of observations.
+func (o *observation) count() int {
+	if o.streamed {
+		return o.n
+	}
+
+	return len(o.obs)
+}
+
+// span returns the times of the first and last observations.  ok is false if there are no observations.
+func (o *observation) span() (first, last time.Time, ok bool) {
+	if o.streamed {
+		return o.first, o.last, o.n > 0
+	}
+
+	if len(o.obs) == 0 {
+		return
+	}
+
+	first, last = o.obs[0].t, o.obs[0].t
+	for _, v := range o.obs {
+		if v.t.Before(first) {
+			first = v.t
+		}
+		if v.t.After(last) {
+			last = v.t
+		}
+	}
+
+	return first, last, true
+}
+
+// maxErrors is the number of row errors collected from an observation file before reading stops.
+var maxErrors = 100
+
+// timeResolution is the resolution observation times are rounded to before they are checked for
+// duplicates and saved.  The DB stores times to the microsecond.
+var timeResolution = time.Microsecond
+
+// truncateTime is true if observation times are truncated rather than rounded to timeResolution.
+var truncateTime bool
+
+// atResolution returns t rounded or truncated to timeResolution.
+func atResolution(t time.Time) time.Time {
+	if truncateTime {
+		return t.Truncate(timeResolution)
+	}
+
+	return t.Round(timeResolution)
+}
+
+// rowError is a problem with a value in a row of an observation file.  row counts from 1 for the first
+// line after the header.
+type rowError struct {
+	row           int
+	column, value string
+	reason        string
+}
+
+func (r rowError) Error() string {
+	return fmt.Sprintf("row %d %s %q: %s", r.row, r.column, r.value, r.reason)
+}
+
+// validationErrors is every problem found reading an observation file.
+type validationErrors struct {
+	errs []rowError
+	// truncated is true if reading stopped at maxErrors.
+	truncated bool
+}
+
+func (v *validationErrors) Error() string {
+	if len(v.errs) == 0 {
+		return "no validation errors"
+	}
+
+	if v.truncated {
+		return fmt.Sprintf("found more than %d validation errors (stopped reading), first: %s", len(v.errs), v.errs[0])
+	}
+
+	return fmt.Sprintf("found %d validation error(s), first: %s", len(v.errs), v.errs[0])
+}
+
+// add appends e unless there are already maxErrors in which case v is marked as truncated.
+func (v *validationErrors) add(e rowError) {
+	if maxErrors > 0 && len(v.errs) >= maxErrors {
+		v.truncated = true
+		return
+	}
+
+	v.errs = append(v.errs, e)
 }
 
-func (o *observation) read(f io.Reader) (err error) {
+// read reads observations from f into o.obs.  Every row is validated and all problems are returned
+// as a *validationErrors, up to maxErrors.  Rows with the same time are errors unless o.policy
+// resolves them.
+func (o *observation) read(f io.Reader) error {
+	o.obs = nil
+	o.resolved = nil
+	o.streamed = false
+
+	err := o.scan(f, func(b []obs) error {
+		o.obs = append(o.obs, b...)
+		return nil
+	})
+
+	var v *validationErrors
+	switch {
+	case errors.As(err, &v):
+	case err != nil:
+		return err
+	default:
+		v = &validationErrors{}
+	}
+
+	dups := findDuplicates(o.obs)
+	o.resolveDuplicates(dups, v)
+
+	// drop the rows for each duplicate time and put back the one that was kept.
+	drop := make(map[int]bool)
+	kept := make(map[int]obs)
+	for _, d := range dups {
+		for _, r := range d.rows {
+			drop[r] = true
+		}
+		kept[d.rows[0]] = d.kept
+	}
+
+	if len(drop) > 0 {
+		var keep []obs
+		for _, ob := range o.obs {
+			if k, ok := kept[ob.row]; ok {
+				keep = append(keep, k)
+				continue
+			}
+			if !drop[ob.row] {
+				keep = append(keep, ob)
+			}
+		}
+		o.obs = keep
+	}
+
+	if len(v.errs) > 0 {
+		sort.SliceStable(v.errs, func(i, j int) bool { return v.errs[i].row < v.errs[j].row })
+		return v
+	}
+
+	return nil
+}
 
+// scan reads and validates the observations in f and calls emit with up to batchSize valid
+// observations at a time.  The slice passed to emit is reused.  Times are not checked for duplicates.
+// Validation problems are returned as a *validationErrors, up to maxErrors.  The number and time span
+// of the valid observations are stored in o.
+func (o *observation) scan(f io.Reader, emit func([]obs) error) (err error) {
 	r := csv.NewReader(f)
 	r.FieldsPerRecord = 3
+	r.ReuseRecord = true
 
 	// read the header line and ignore it.
 	_, err = r.Read()
@@ -29,52 +249,86 @@ func (o *observation) read(f io.Reader) (err error) {
 		return err
 	}
 
-	rawObs, err := r.ReadAll()
-	if err != nil {
-		return err
-	}
-
-	o.obs = make([]obs, len(rawObs))
+	o.n, o.first, o.last = 0, time.Time{}, time.Time{}
 
-	for i, r := range rawObs {
-		obs := obs{}
+	var v validationErrors
+	b := make([]obs, 0, batchSize)
 
-		obs.t, err = time.Parse(time.RFC3339Nano, r[0])
+	for i := 1; !v.truncated; i++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("error parsing date time in row %d: %s", i+1, r[0])
+			var p *csv.ParseError
+			if errors.As(err, &p) && p.Err == csv.ErrFieldCount {
+				v.add(rowError{row: i, column: "row", value: strings.Join(rec, ","), reason: fmt.Sprintf("expected 3 columns got %d", len(rec))})
+				continue
+			}
+			return err
 		}
 
-		obs.v, err = strconv.ParseFloat(r[1], 64)
+		obs := obs{row: i, ts: rec[0]}
+		ok := true
+
+		obs.t, err = time.Parse(time.RFC3339Nano, rec[0])
 		if err != nil {
-			return fmt.Errorf("error parsing value in row %d: %s", i+1, r[1])
+			ok = false
+			v.add(rowError{row: i, column: "date time", value: rec[0], reason: "error parsing date time"})
 		}
-		if math.IsNaN(obs.v) {
-			return fmt.Errorf("Found NaN value in row %d: %s", i+1, r[1])
+
+		obs.vs = rec[1]
+		if r := checkDecimal(rec[1]); r == "" {
+			obs.v = parseDecimal(rec[1])
+		} else {
+			ok = false
+			v.add(rowError{row: i, column: "value", value: rec[1], reason: "value " + r})
 		}
 
-		obs.e, err = strconv.ParseFloat(r[2], 64)
-		if err != nil {
-			return fmt.Errorf("error parsing error in row %d: %s", i+1, r[2])
+		obs.es = rec[2]
+		if r := checkDecimal(rec[2]); r == "" {
+			obs.e = parseDecimal(rec[2])
+		} else {
+			ok = false
+			v.add(rowError{row: i, column: "error", value: rec[2], reason: "error " + r})
 		}
-		if math.IsNaN(obs.e) {
-			return fmt.Errorf("Found NaN error in row %d: %s", i+1, r[2])
+
+		if !ok {
+			continue
 		}
 
-		o.obs[i] = obs
-	}
+		obs.t = atResolution(obs.t)
 
-	// Check for duplicate date times in the data.
-	d := make(map[string]int, len(o.obs))
+		if o.n == 0 || obs.t.Before(o.first) {
+			o.first = obs.t
+		}
+		if o.n == 0 || obs.t.After(o.last) {
+			o.last = obs.t
+		}
+		o.n++
 
-	for _, v := range o.obs {
-		d[v.t.Format(time.RFC3339)] = 1
+		if emit == nil {
+			continue
+		}
+
+		b = append(b, obs)
+		if len(b) == batchSize {
+			if err = emit(b); err != nil {
+				return err
+			}
+			b = b[:0]
+		}
 	}
 
-	dups := len(o.obs) - len(d)
+	if emit != nil && len(b) > 0 {
+		if err = emit(b); err != nil {
+			return err
+		}
+	}
 
-	if dups != 0 {
-		return fmt.Errorf("found %d duplicate timestamp(s)", dups)
+	if len(v.errs) > 0 {
+		return &v
 	}
 
-	return err
+	return nil
 }
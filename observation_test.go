@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestObservation(t *testing.T) {
@@ -97,3 +101,212 @@ func TestObservation(t *testing.T) {
 	f.Close()
 
 }
+
+func TestObservationErrors(t *testing.T) {
+	f, err := os.Open("etc/errors/VGT2_e_multi_error.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	o := observation{}
+
+	err = o.read(f)
+
+	var v *validationErrors
+	if !errors.As(err, &v) {
+		t.Fatalf("expected validation errors got %v", err)
+	}
+
+	expected := []rowError{
+		{row: 2, column: "date time", value: "12-08-01T11:58:56.000000Z", reason: "error parsing date time"},
+		{row: 3, column: "value", value: "1a.03", reason: "value is not a decimal number"},
+		{row: 4, column: "error", value: "nan", reason: "error is not a decimal number"},
+		{row: 5, column: "row", value: "2012-08-04T12:01:04.000000Z,4.33", reason: "expected 3 columns got 2"},
+		{row: 6, column: "date time", value: "2012-07-31T12:01:04.000000Z", reason: "duplicate timestamp, first seen in row 1"},
+	}
+
+	if !reflect.DeepEqual(expected, v.errs) {
+		t.Errorf("expected errors %v got %v", expected, v.errs)
+	}
+
+	if v.truncated {
+		t.Error("errors should not be truncated")
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	m := maxErrors
+	defer func() { maxErrors = m }()
+	maxErrors = 2
+
+	err = o.read(f)
+
+	if !errors.As(err, &v) {
+		t.Fatalf("expected validation errors got %v", err)
+	}
+
+	if len(v.errs) != 2 || !v.truncated {
+		t.Errorf("expected 2 truncated errors got %d truncated %t", len(v.errs), v.truncated)
+	}
+}
+
+func TestObservationDecimal(t *testing.T) {
+	in := `date time, e (mm), error (mm)
+2012-07-31T12:01:04.000000Z,0.000000000000000000000000000012345678901234567890,1E-320
+2012-08-01T11:58:56.000000Z,123456789012345678901234567890.123456789,.1
+2012-08-02T12:01:04.000000Z,1e400,-1E-400
+`
+
+	o := observation{}
+
+	if err := o.read(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]string{
+		{"0.000000000000000000000000000012345678901234567890", "1E-320"},
+		{"123456789012345678901234567890.123456789", ".1"},
+		// beyond the range of a float64 but still decimals.
+		{"1e400", "-1E-400"},
+	}
+
+	if len(o.obs) != len(expected) {
+		t.Fatalf("expected %d observations got %d", len(expected), len(o.obs))
+	}
+
+	for i, e := range expected {
+		if o.obs[i].vs != e[0] || o.obs[i].es != e[1] {
+			t.Errorf("row %d expected %s, %s got %s, %s", i+1, e[0], e[1], o.obs[i].vs, o.obs[i].es)
+		}
+	}
+
+	// numbers that parse as floats but are not decimals.
+	for _, v := range []string{"Inf", "NaN", "0x1p-2", "1_000"} {
+		o = observation{}
+
+		err := o.read(strings.NewReader("date time, e (mm), error (mm)\n2012-07-31T12:01:04.000000Z," + v + ",1\n"))
+		if err == nil {
+			t.Errorf("expected an error for value %s", v)
+		}
+	}
+
+	// decimals that can't be stored in a NUMERIC column.
+	for _, v := range []string{"1e200000", "1e1001", "1E-1001", "1e99999999999999999999", "1" + strings.Repeat("0", 131072) + "e0",
+		"0." + strings.Repeat("1", 16384), "0." + strings.Repeat("1", 15384) + "e-1000"} {
+		o = observation{}
+
+		err := o.read(strings.NewReader("date time, e (mm), error (mm)\n2012-07-31T12:01:04.000000Z," + v + ",1\n"))
+
+		var ve *validationErrors
+		if !errors.As(err, &ve) || len(ve.errs) != 1 || ve.errs[0].column != "value" {
+			t.Errorf("expected a value error for %.20s got %v", v, err)
+		}
+	}
+
+	// the largest decimals that can be stored.
+	for _, v := range []string{"1e1000", "-1E-1000", "1" + strings.Repeat("0", 131071), "0." + strings.Repeat("1", 16383), "0." + strings.Repeat("1", 15383) + "e-1000"} {
+		o = observation{}
+
+		if err := o.read(strings.NewReader("date time, e (mm), error (mm)\n2012-07-31T12:01:04.000000Z," + v + ",1\n")); err != nil {
+			t.Errorf("expected no error for %.20s got %v", v, err)
+		}
+	}
+}
+
+func TestObservationTimeResolution(t *testing.T) {
+	defer func(r time.Duration, tr bool) { timeResolution, truncateTime = r, tr }(timeResolution, truncateTime)
+
+	in := `date time, e (mm), error (mm)
+2012-07-31T12:01:04.000001Z,1.0,0.1
+2012-07-31T12:01:04.000002Z,1.1,0.1
+2012-07-31T12:01:04.6Z,1.2,0.1
+`
+
+	o := observation{}
+
+	if err := o.read(strings.NewReader(in)); err != nil {
+		t.Errorf("expected no duplicates at microsecond resolution: %s", err)
+	}
+
+	if len(o.obs) != 3 {
+		t.Errorf("expected 3 observations got %d", len(o.obs))
+	}
+
+	timeResolution = time.Second
+
+	o = observation{}
+
+	err := o.read(strings.NewReader(in))
+
+	var v *validationErrors
+	if !errors.As(err, &v) {
+		t.Fatalf("expected *validationErrors got %v", err)
+	}
+
+	// rounding puts the first two rows at 12:01:04 and the last at 12:01:05.
+	if len(v.errs) != 1 || v.errs[0].row != 2 || !strings.Contains(v.errs[0].reason, "collides with row 1") {
+		t.Errorf("expected a collision for row 2 got %v", v.errs)
+	}
+
+	if len(o.obs) != 2 || !o.obs[1].t.Equal(time.Date(2012, 7, 31, 12, 1, 5, 0, time.UTC)) {
+		t.Errorf("expected the last observation rounded to 12:01:05 got %v", o.obs)
+	}
+
+	truncateTime = true
+
+	o = observation{}
+
+	err = o.read(strings.NewReader(in))
+	if !errors.As(err, &v) {
+		t.Fatalf("expected *validationErrors got %v", err)
+	}
+
+	if len(v.errs) != 2 {
+		t.Errorf("expected 2 collisions when truncating got %v", v.errs)
+	}
+}
+
+func TestScan(t *testing.T) {
+	defer func(n int) { batchSize = n }(batchSize)
+	batchSize = 3
+
+	f, err := os.Open("etc/VGT2_e.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	o := observation{}
+
+	var sizes []int
+	var rows []int
+
+	err = o.scan(f, func(b []obs) error {
+		sizes = append(sizes, len(b))
+		for _, v := range b {
+			rows = append(rows, v.row)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sizes, []int{3, 3, 1}) {
+		t.Errorf("expected batches of 3, 3, and 1 got %v", sizes)
+	}
+
+	if !reflect.DeepEqual(rows, []int{1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("expected rows 1 to 7 got %v", rows)
+	}
+
+	o.streamed = true
+
+	first, last, ok := o.span()
+	if o.count() != 7 || !ok || !first.Equal(time.Date(2012, 7, 31, 12, 1, 4, 0, time.UTC)) || !last.Equal(time.Date(2012, 8, 6, 12, 1, 4, 0, time.UTC)) {
+		t.Errorf("wrong count or span %d %s %s", o.count(), first, last)
+	}
+}
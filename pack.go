@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	packOutput, packBucket, packProducer string
+	packManifest                         bool
+)
+
+// packFlags adds the flags for the pack command.
+func packFlags() {
+	flag.StringVar(&packOutput, "output", "", "optional path for the archive.  Defaults to <unix time>.tar.gz, prefixed with df. for --delete-first.")
+	flag.BoolVar(&packManifest, "manifest", false, "add a manifest with checksums to the archive.  Always added for --delete-first and --sync-window.")
+	flag.StringVar(&packProducer, "producer", "", "optional producer name for the manifest.  Defaults to the host name.")
+	flag.StringVar(&packBucket, "bucket", "", "optional S3 bucket to upload the archive to e.g., fits-spool.")
+	awsFlags()
+}
+
+// pack validates the files in dataDir without a DB connection and writes them to a tar.gz
+// archive that can be loaded with --archive or serve-sqs.  It returns the exit code.
+func pack() int {
+	if dataDir == "" {
+		fatal("please specify the data directory")
+	}
+
+	if !windowStart.IsZero() || !windowEnd.IsZero() {
+		fatal("--window-start and --window-end are not packed, set windowStart and windowEnd in the source files instead")
+	}
+
+	log.Printf("searching for observation and source data in %s", dataDir)
+	proc, err := scan(dataDir)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	if len(proc) == 0 {
+		log.Printf("ERROR - found no observation files in %s", dataDir)
+		return exitFailed
+	}
+
+	start := time.Now().UTC()
+
+	code := loadAll(proc)
+
+	if err := finish(start, proc); err != nil && code == exitOK {
+		code = exitFailed
+	}
+
+	if code != exitOK {
+		log.Println("ERROR - not packing files that failed validation")
+		return code
+	}
+
+	m := defaultMode()
+
+	name := packOutput
+	if name == "" {
+		name = fmt.Sprintf("%d.tar.gz", time.Now().Unix())
+		if m == deleteFirstMode {
+			name = "df." + name
+		}
+	}
+
+	// the mode is always in the manifest for a sync as the archive name may not have the df. prefix.
+	var mf *manifest
+	if packManifest || m != updateOrAddMode {
+		mf = &manifest{Producer: packProducer, Mode: m.String()}
+		if mf.Producer == "" {
+			mf.Producer, _ = os.Hostname()
+		}
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	if err = writeBundle(f, proc, mf); err != nil {
+		f.Close()
+		log.Printf("ERROR - writing %s: %s", name, err)
+		return exitFailed
+	}
+
+	if err = f.Close(); err != nil {
+		log.Print(err)
+		return exitFailed
+	}
+
+	log.Printf("wrote %d observation files to %s", len(proc), name)
+
+	if packBucket == "" {
+		return exitOK
+	}
+
+	if err = upload(context.Background(), name, packBucket); err != nil {
+		log.Printf("ERROR - uploading %s to %s: %s", name, packBucket, err)
+		return exitConfig
+	}
+
+	log.Printf("uploaded %s to s3://%s/%s", name, packBucket, path.Base(name))
+
+	return exitOK
+}
+
+// writeBundle writes the observation and source files for proc to w as a tar.gz archive
+// in the same layout as fits-s3-upload.sh.  If m is not nil the checksum for each file is
+// added to it and it is written to the archive as the manifest.
+func writeBundle(w io.Writer, proc []data, m *manifest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	add := func(name string, b []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     "./" + name,
+			Mode:     0644,
+			Size:     int64(len(b)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(b)
+		return err
+	}
+
+	for i := range proc {
+		for _, n := range []string{proc[i].observationFile, proc[i].sourceFile} {
+			b, err := proc[i].readFile(n)
+			if err != nil {
+				return err
+			}
+
+			name := filepath.Base(n)
+
+			if err = add(name, b); err != nil {
+				return err
+			}
+
+			if m != nil {
+				sum := sha256.Sum256(b)
+				m.Files = append(m.Files, manifestEntry{Name: name, SHA256: hex.EncodeToString(sum[:])})
+			}
+		}
+	}
+
+	if m != nil {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err = add(manifestFile, b); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// upload puts the file name in bucket using the base name as the key.
+func upload(ctx context.Context, name, bucket string) error {
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = newS3Client(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(path.Base(name)),
+		Body:   f,
+	})
+
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBundle(t *testing.T) {
+	proc, err := scan("etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	if err = writeBundle(&b, proc, &manifest{Producer: "test", Mode: "delete-first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := readArchive(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []string{"VGT2_e.csv", "VGT2_e.json", manifestFile} {
+		if _, ok := a[n]; !ok {
+			t.Errorf("expected %s in the archive", n)
+		}
+	}
+
+	c, err := os.ReadFile("etc/VGT2_e.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(c, a["VGT2_e.csv"]) {
+		t.Error("observation file changed in the archive")
+	}
+
+	p := scanArchive(a)
+
+	if err = checkManifest(a, p); err != nil {
+		t.Error(err)
+	}
+
+	if len(p) != 1 || p[0].mode != deleteFirstMode {
+		t.Errorf("expected one delete-first observation file got %+v", p)
+	}
+}
+
+func TestPackMode(t *testing.T) {
+	defer func() {
+		dataDir, packOutput, locValid, deleteFirst = "", "", false, false
+	}()
+
+	dataDir, locValid, deleteFirst = "etc", true, true
+
+	// the name has no df. prefix so the mode must come from the manifest.
+	packOutput = filepath.Join(t.TempDir(), "x.tar.gz")
+
+	if c := pack(); c != exitOK {
+		t.Fatalf("expected exit code %d got %d", exitOK, c)
+	}
+
+	f, err := os.Open(packOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := readArchive(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteFirst = false
+
+	p := scanArchive(a)
+	for i := range p {
+		p[i].mode = bundleMode(packOutput)
+	}
+
+	if err = checkManifest(a, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p) != 1 || p[0].mode != deleteFirstMode {
+		t.Errorf("expected one delete-first observation file got %+v", p)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	f := &fakeAWS{objects: map[string][]byte{}}
+
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	awsEndpoint, awsRegion = ts.URL, "ap-southeast-2"
+	defer func() { awsEndpoint, awsRegion = "", "" }()
+
+	name := filepath.Join(t.TempDir(), "df.1234.tar.gz")
+	b := tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json")
+
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upload(context.Background(), name, "fits-spool"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, f.objects["/fits-spool/df.1234.tar.gz"]) {
+		t.Error("expected the archive to be uploaded to fits-spool")
+	}
+}
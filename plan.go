@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var planPath string
+
+// planFlags adds the flags for the plan command.
+func planFlags() {
+	flag.StringVar(&planPath, "plan-file", "fits-loader.plan", "the file to write the plan to.")
+}
+
+// plan is what loading a set of files would do to the DB.  It is made by the plan command and
+// executed by the apply command.
+type plan struct {
+	Version        string     `json:"version"`
+	Created        time.Time  `json:"created"`
+	TimeResolution string     `json:"timeResolution"`
+	TruncateTime   bool       `json:"truncateTime,omitempty"`
+	Duplicates     string     `json:"duplicates,omitempty"`
+	Files          []planFile `json:"files"`
+}
+
+// planFile is what loading a source and observation file would do.  SiteState and SeriesState are
+// the state of the live site and series when the plan was made.
+type planFile struct {
+	SourceFile      string     `json:"sourceFile"`
+	ObservationFile string     `json:"observationFile"`
+	Mode            string     `json:"mode"`
+	WindowStart     *time.Time `json:"windowStart,omitempty"`
+	WindowEnd       *time.Time `json:"windowEnd,omitempty"`
+	SHA256          string     `json:"sha256"`
+	// Site is create, change, or unchanged.
+	Site        string    `json:"site"`
+	SiteChanges []string  `json:"siteChanges,omitempty"`
+	SiteState   *liveSite `json:"siteState,omitempty"`
+	SeriesState string    `json:"seriesState"`
+	obsCounts
+}
+
+// makePlan validates the files in dataDir and writes a plan of what loading them would do to
+// planPath.  Nothing is changed in the DB.  It returns the exit code.
+func makePlan() int {
+	if dataDir == "" {
+		fatal("please specify the data directory")
+	}
+
+	if dryRun || locValid || atomicLoad || stagingLoad || useLedger {
+		fatal("--dry-run, --local-validate, --atomic, --staging, and --ledger can't be used with plan")
+	}
+
+	log.Printf("searching for observation and source data in %s", dataDir)
+	proc, err := scan(dataDir)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	if err := checkManifest(os.DirFS(dataDir), proc); err != nil {
+		log.Printf("ERROR - rejecting %s: %s", dataDir, err)
+		return exitFailed
+	}
+
+	if err := config.initDB(); err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	p := plan{
+		Version:        vers,
+		Created:        time.Now().UTC(),
+		TimeResolution: timeResolution.String(),
+		TruncateTime:   truncateTime,
+		Duplicates:     duplicates,
+	}
+
+	code := exitOK
+
+	for i := range proc {
+		d := &proc[i]
+
+		f, err := d.plan()
+		if err != nil {
+			d.err = err
+			log.Printf("ERROR - planning %s: %s", d.observationFile, err)
+			code = exitFailed
+			continue
+		}
+
+		p.Files = append(p.Files, f)
+	}
+
+	if code != exitOK {
+		summary(os.Stdout, proc)
+		log.Println("ERROR - not writing a plan for files that failed validation")
+		return code
+	}
+
+	p.summary(os.Stdout)
+
+	if err = p.write(planPath); err != nil {
+		log.Printf("ERROR - writing plan to %s: %s", planPath, err)
+		return exitConfig
+	}
+
+	log.Printf("wrote plan to %s", planPath)
+
+	return exitOK
+}
+
+// plan validates d and returns what loading it would do.
+func (d *data) plan() (f planFile, err error) {
+	if err = validate(d); err != nil {
+		return f, err
+	}
+
+	f = planFile{
+		SourceFile:      d.sourceFile,
+		ObservationFile: d.observationFile,
+		Mode:            d.mode.String(),
+	}
+
+	if d.mode == syncWindowMode {
+		f.WindowStart, f.WindowEnd = &d.window.start, &d.window.end
+	}
+
+	if f.SHA256, err = d.contentHash(); err != nil {
+		return f, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return f, err
+	}
+	// nothing is changed by a plan.
+	defer tx.Rollback()
+
+	s, ok, err := d.liveSite(tx)
+	if err != nil {
+		return f, err
+	}
+
+	if !ok {
+		f.Site = "create"
+		f.SeriesState = "0/0"
+
+		// the observations are copied, as when they are saved, so duplicates in streamed files are
+		// checked and resolved before they are counted.
+		if err = d.copyObs(tx); err != nil {
+			return f, err
+		}
+
+		if err = tx.QueryRow(`SELECT count(*) FROM loader_observation`).Scan(&f.Inserted); err != nil {
+			return f, err
+		}
+
+		_, err = tx.Exec(`DROP TABLE loader_observation`)
+
+		return f, err
+	}
+
+	f.SiteState = &s
+	f.SiteChanges = d.siteChanges(s)
+	f.Site = "unchanged"
+	if len(f.SiteChanges) > 0 {
+		f.Site = "change"
+	}
+
+	k, err := d.seriesKey(tx)
+	if err != nil {
+		return f, err
+	}
+
+	if f.SeriesState, err = seriesState(tx, k); err != nil {
+		return f, err
+	}
+
+	f.obsCounts, err = d.compareObs(tx, k)
+
+	return f, err
+}
+
+// summary writes a table of the changes in p to w.
+func (p plan) summary(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "FILE\tMODE\tSITE\tINSERT\tUPDATE\tDELETE\tUNCHANGED")
+
+	var c obsCounts
+
+	for _, f := range p.Files {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", f.ObservationFile, f.Mode, f.Site, f.Inserted, f.Updated, f.Deleted, f.Unchanged)
+		c.Inserted += f.Inserted
+		c.Updated += f.Updated
+		c.Deleted += f.Deleted
+		c.Unchanged += f.Unchanged
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d files: %d to insert, %d to update, %d to delete, %d unchanged\n", len(p.Files), c.Inserted, c.Updated, c.Deleted, c.Unchanged)
+}
+
+// write writes p as JSON to the file name.
+func (p plan) write(name string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(b, '\n'), 0644)
+}
+
+// readPlan reads the plan in the file name.
+func readPlan(name string) (p plan, err error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return p, err
+	}
+
+	if err = json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("error parsing plan %s: %w", name, err)
+	}
+
+	return p, nil
+}
+
+// errPlanChanged is returned by apply when the files or the DB have changed since the plan was made.
+var errPlanChanged = errors.New("changed since the plan was made")
+
+// applyPlan loads the files in the plan file name in a single transaction, only if none of
+// the files and none of the affected sites and series have changed since the plan was made.
+// It returns the exit code.
+func applyPlan(name string) int {
+	if name == "" {
+		fatal("please specify the plan file")
+	}
+
+	if dryRun || locValid || stagingLoad || useLedger {
+		fatal("--dry-run, --local-validate, --staging, and --ledger can't be used with apply")
+	}
+
+	p, err := readPlan(name)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	if p.Version != vers {
+		log.Printf("ERROR - plan %s was made by version %s, this is version %s", name, p.Version, vers)
+		return exitConfig
+	}
+
+	if timeResolution, err = time.ParseDuration(p.TimeResolution); err != nil {
+		log.Printf("ERROR - plan %s: %s", name, err)
+		return exitConfig
+	}
+	truncateTime = p.TruncateTime
+	duplicates = p.Duplicates
+
+	if err = config.initDB(); err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	proc := make([]data, len(p.Files))
+
+	for i, f := range p.Files {
+		m, err := parseMode(f.Mode)
+		if err != nil {
+			log.Printf("ERROR - plan %s: %s", name, err)
+			return exitConfig
+		}
+
+		proc[i] = data{sourceFile: f.SourceFile, observationFile: f.ObservationFile, mode: m}
+	}
+
+	start := time.Now().UTC()
+	loadID = newLoadID(start)
+
+	if recording() {
+		sum, err := fileChecksum(name)
+		if err != nil {
+			log.Printf("ERROR - checksum for load %s: %s", loadID, err)
+		}
+
+		startLoad("apply", name, sum, start)
+	}
+
+	var failed bool
+
+	for i, f := range p.Files {
+		d := &proc[i]
+
+		if err = d.checkPlan(f); err != nil {
+			d.err = err
+			log.Printf("ERROR - applying %s: %s", d.observationFile, err)
+			failed = true
+		}
+	}
+
+	code := exitFailed
+
+	if !failed {
+		code = saveAll(proc, p.checkAll(proc))
+	}
+
+	if err := finish(start, proc); err != nil && code == exitOK {
+		code = exitFailed
+	}
+
+	finishLoad(proc)
+
+	return code
+}
+
+// checkPlan validates d, sets the window from the plan, and checks that the files have not
+// changed since f was planned.
+func (d *data) checkPlan(f planFile) error {
+	if err := validate(d); err != nil {
+		return err
+	}
+
+	if f.WindowStart != nil && f.WindowEnd != nil {
+		if err := d.setWindow(*f.WindowStart, *f.WindowEnd); err != nil {
+			return err
+		}
+	}
+
+	h, err := d.contentHash()
+	if err != nil {
+		return err
+	}
+
+	if h != f.SHA256 {
+		return fmt.Errorf("files %w", errPlanChanged)
+	}
+
+	return nil
+}
+
+// checkAll returns a check for saveAll that makes the transaction serializable and then checks that
+// the live site and series for each of proc are the same as when p was made.  Every series is checked
+// before any are changed as a plan can have more than one file for a series.  The transaction fails
+// to commit if anything it checked is changed by another transaction before it commits.
+func (p plan) checkAll(proc []data) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL SERIALIZABLE`); err != nil {
+			return err
+		}
+
+		for i := range proc {
+			if err := proc[i].checkState(tx, p.Files[i]); err != nil {
+				proc[i].err = err
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// checkState checks that the live site and series for d are the same as when f was planned.
+func (d *data) checkState(tx *sql.Tx, f planFile) error {
+	s, ok, err := d.liveSite(tx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ok != (f.SiteState != nil):
+		return fmt.Errorf("site %s %w", d.Properties.SiteID, errPlanChanged)
+	case ok && s != *f.SiteState:
+		return fmt.Errorf("site %s %w", d.Properties.SiteID, errPlanChanged)
+	case !ok:
+		return nil
+	}
+
+	k, err := d.seriesKey(tx)
+	if err != nil {
+		return err
+	}
+
+	state, err := seriesState(tx, k)
+	if err != nil {
+		return err
+	}
+
+	if state != f.SeriesState {
+		return fmt.Errorf("observations for %s.%s %w", d.Properties.SiteID, d.Properties.TypeID, errPlanChanged)
+	}
+
+	return nil
+}
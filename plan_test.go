@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanFile(t *testing.T) {
+	ws, we := time.Date(2012, 7, 31, 0, 0, 0, 0, time.UTC), time.Date(2012, 8, 7, 0, 0, 0, 0, time.UTC)
+
+	p := plan{
+		Version:        vers,
+		Created:        time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		TimeResolution: time.Second.String(),
+		Duplicates:     "last",
+		Files: []planFile{
+			{
+				SourceFile:      "etc/VGT2_e.json",
+				ObservationFile: "etc/VGT2_e.csv",
+				Mode:            "sync-window",
+				WindowStart:     &ws,
+				WindowEnd:       &we,
+				SHA256:          "abc",
+				Site:            "change",
+				SiteChanges:     []string{`name "Te Maari" to "Te Maari 2"`},
+				SiteState:       &liveSite{Name: "Te Maari", Longitude: 175.67, Latitude: -39.1, Height: -999.9, GroundRelationship: -999.9},
+				SeriesState:     "3/1234",
+				obsCounts:       obsCounts{Inserted: 4, Updated: 1, Deleted: 1, Unchanged: 1},
+			},
+			{
+				SourceFile:      "etc/VGT3_e.json",
+				ObservationFile: "etc/VGT3_e.csv",
+				Mode:            "update-or-add",
+				SHA256:          "def",
+				Site:            "create",
+				SeriesState:     "0/0",
+				obsCounts:       obsCounts{Inserted: 7},
+			},
+		},
+	}
+
+	name := filepath.Join(t.TempDir(), "fits-loader.plan")
+
+	if err := p.write(name); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := readPlan(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p, r) {
+		t.Errorf("expected plan %+v got %+v", p, r)
+	}
+
+	var b bytes.Buffer
+	p.summary(&b)
+
+	if !strings.Contains(b.String(), "2 files: 11 to insert, 1 to update, 1 to delete, 1 unchanged") {
+		t.Errorf("unexpected summary:\n%s", b.String())
+	}
+}
+
+func TestPlan(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+		mode:            deleteFirstMode,
+	}
+
+	f, err := d.plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Site != "create" || f.Inserted != 7 || f.SiteState != nil {
+		t.Errorf("expected the site to be created and 7 inserts got %+v", f)
+	}
+
+	if err = withTx(d.save); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE fits.observation SET value = 10 WHERE time = '2012-08-01T11:58:56Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO fits.observation (sitepk, typepk, methodpk, samplepk, time, value, error)
+		SELECT sitepk, typepk, methodpk, samplepk, '2012-09-01T00:00:00Z', 1, 1 FROM fits.observation LIMIT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE fits.site SET height = 10 WHERE siteID = 'VGT2'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+		mode:            deleteFirstMode,
+	}
+
+	if f, err = d.plan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Site != "change" || !reflect.DeepEqual(f.SiteChanges, []string{"height 10 to -999.9"}) {
+		t.Errorf("expected a height change got %s %v", f.Site, f.SiteChanges)
+	}
+
+	if e := (obsCounts{Inserted: 0, Updated: 1, Deleted: 1, Unchanged: 6}); f.obsCounts != e {
+		t.Errorf("expected %+v got %+v", e, f.obsCounts)
+	}
+
+	check := func(tx *sql.Tx) error { return d.checkState(tx, f) }
+
+	if err = withTx(check); err != nil {
+		t.Errorf("expected no change since planning got %s", err)
+	}
+
+	_, err = db.Exec(`DELETE FROM fits.observation WHERE time = '2012-09-01T00:00:00Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = withTx(check); !errors.Is(err, errPlanChanged) {
+		t.Errorf("expected the series to have changed got %v", err)
+	}
+
+	// the check for apply makes the transaction serializable.
+	p := plan{Files: []planFile{f}}
+
+	err = withTx(func(tx *sql.Tx) error {
+		if err := p.checkAll([]data{d})(tx); !errors.Is(err, errPlanChanged) {
+			t.Errorf("expected the series to have changed got %v", err)
+		}
+
+		var level string
+		if err := tx.QueryRow(`SHOW transaction_isolation`).Scan(&level); err != nil {
+			return err
+		}
+
+		if level != "serializable" {
+			t.Errorf("expected a serializable transaction got %s", level)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := saveAll([]data{d}, check); c != exitFailed {
+		t.Errorf("expected exit code %d got %d", exitFailed, c)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("expected the plan not to be applied")
+	}
+}
+
+func TestPlanNewSiteDuplicates(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	defer func() { duplicates = "" }()
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/errors/VGT2_e_dups.csv",
+	}
+
+	// duplicates in a streamed file are only found when the observations are copied.
+	if _, err := d.plan(); err == nil {
+		t.Error("expected an error planning a file with duplicates for a new site")
+	}
+
+	duplicates = "last"
+
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/errors/VGT2_e_dups.csv",
+	}
+
+	f, err := d.plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Site != "create" || f.Inserted != 7 {
+		t.Errorf("expected the site to be created and 7 inserts got %+v", f)
+	}
+}
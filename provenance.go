@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	// provenance is true if each load and the files in it are recorded in fits.loader_load and
+	// fits.loader_load_file.
+	provenance = true
+	// loadStarted is true if the current load was recorded by startLoad.  Nothing else is recorded
+	// for the load if it wasn't, e.g., when its load ID is already in use.
+	loadStarted bool
+
+	historySite, historyType string
+	historyFrom, historyTo   time.Time
+	historyFiles             bool
+)
+
+// historyFlags adds the flags for the history command.
+func historyFlags() {
+	flag.StringVar(&historySite, "site", "", "optional siteID to list loads for e.g., VGT2.")
+	flag.StringVar(&historyType, "type", "", "optional typeID to list loads for e.g., e.")
+	flag.Func("from", "optional RFC3339 time to list loads started from.", parseTime(&historyFrom))
+	flag.Func("to", "optional RFC3339 time to list loads started up to.", parseTime(&historyTo))
+	flag.BoolVar(&historyFiles, "files", false, "list the files in each load instead of the loads.")
+}
+
+// loadRecord is a load in fits.loader_load.  finished is zero for a load that has not finished.
+type loadRecord struct {
+	id, operator, host, version, mode string
+	started, finished                 time.Time
+	bundle, checksum                  string
+	files, failed                     int
+}
+
+// loadFileRecord is a file in a load in fits.loader_load_file.
+type loadFileRecord struct {
+	id, file, series, mode     string
+	observations               int64
+	inserted, updated, deleted int64
+	skipped                    bool
+	err                        string
+}
+
+const insertLoadFile = `INSERT INTO fits.loader_load_file(load_id, observation_file, siteID, typeID, methodID, sampleID, systemID,
+			mode, observations, inserted, updated, deleted, skipped, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+
+// recording returns true if loads are being recorded.  Nothing is recorded when nothing can be saved.
+func recording() bool {
+	return provenance && loadID != "" && !(dryRun || locValid)
+}
+
+// startLoad records the start of the load in mode, at start, in fits.loader_load.  name and checksum
+// identify the directory, archive, or plan the files are loaded from.  Recording never stops a load so
+// a failure, e.g., a load ID already used by another loader, is only logged.
+func startLoad(mode, name, checksum string, start time.Time) {
+	loadStarted = false
+
+	if !recording() {
+		return
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	_, err = db.Exec(`INSERT INTO fits.loader_load(load_id, operator, host, version, mode, started, bundle, bundle_sha256)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		loadID, operator(), host, vers, mode, start, name, checksum)
+	if err != nil {
+		log.Printf("ERROR - recording the start of load %s, not recording the load: %s", loadID, err)
+		return
+	}
+
+	loadStarted = true
+}
+
+// recordFile records the outcome for d in fits.loader_load_file using tx, the transaction d is saved
+// in, so it is recorded if and only if d is saved.  It is done in a savepoint so a failure is logged
+// and does not roll back the file.
+func (d *data) recordFile(tx *sql.Tx) {
+	if !recording() || !loadStarted {
+		return
+	}
+
+	if _, err := tx.Exec(`SAVEPOINT loader_load_file`); err != nil {
+		log.Printf("ERROR - recording %s in load %s: %s", d.observationFile, loadID, err)
+		return
+	}
+
+	if _, err := tx.Exec(insertLoadFile, loadFileArgs(d.report())...); err != nil {
+		log.Printf("ERROR - recording %s in load %s: %s", d.observationFile, loadID, err)
+
+		if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT loader_load_file`); err != nil {
+			log.Printf("ERROR - recording %s in load %s: %s", d.observationFile, loadID, err)
+		}
+		return
+	}
+
+	if _, err := tx.Exec(`RELEASE SAVEPOINT loader_load_file`); err != nil {
+		log.Printf("ERROR - recording %s in load %s: %s", d.observationFile, loadID, err)
+	}
+}
+
+// finishLoad records the end of the load of proc in fits.loader_load along with the outcome for each
+// file that was not recorded when it was saved, e.g., because it failed, was skipped, or was rolled
+// back.  A failure is only logged.
+func finishLoad(proc []data) {
+	if !recording() || !loadStarted {
+		return
+	}
+
+	r := newReport("", time.Time{}, proc)
+
+	var failed int
+	for _, f := range r.Files {
+		if f.Error != "" {
+			failed++
+		}
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE fits.loader_load SET finished = $2, files = $3, failed = $4 WHERE load_id = $1`,
+			loadID, r.End, len(r.Files), failed)
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare(insertLoadFile + ` ON CONFLICT (load_id, observation_file) DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, f := range r.Files {
+			if _, err = stmt.Exec(loadFileArgs(f)...); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR - recording the end of load %s: %s", loadID, err)
+		return
+	}
+
+	log.Printf("recorded load %s", loadID)
+}
+
+// loadFileArgs returns the arguments for insertLoadFile for f.
+func loadFileArgs(f fileReport) []interface{} {
+	var p sourceProperties
+	if f.Properties != nil {
+		p = *f.Properties
+	}
+
+	return []interface{}{loadID, f.ObservationFile, p.SiteID, p.TypeID, p.MethodID, p.SampleID, p.SystemID,
+		f.Mode, f.Observations, f.Inserted, f.Updated, f.Deleted, f.Skipped, f.Error}
+}
+
+// operator returns the name of the user running the loader.
+func operator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+
+	return "unknown"
+}
+
+// fsChecksum returns the SHA-256 of the names and contents of the regular files at the top level of
+// fsys, in name order.
+func fsChecksum(fsys fs.FS) (string, error) {
+	e, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	for _, f := range e {
+		if !f.Type().IsRegular() {
+			continue
+		}
+
+		r, err := fsys.Open(f.Name())
+		if err != nil {
+			return "", err
+		}
+
+		io.WriteString(h, f.Name()+"\x00")
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileChecksum returns the SHA-256 of the file name.
+func fileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// history writes the loads, or the files in them, that match the filters to stdout.  It returns the
+// exit code.
+func history() int {
+	if err := config.initDB(); err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	if historyFiles {
+		f, err := queryLoadFiles()
+		if err != nil {
+			log.Printf("ERROR - listing loads: %s", err)
+			return exitFailed
+		}
+
+		writeLoadFiles(os.Stdout, f)
+
+		return exitOK
+	}
+
+	l, err := queryLoads()
+	if err != nil {
+		log.Printf("ERROR - listing loads: %s", err)
+		return exitFailed
+	}
+
+	writeLoads(os.Stdout, l)
+
+	return exitOK
+}
+
+// queryLoads returns the loads that started between historyFrom and historyTo and, if historySite
+// or historyType are set, loaded a file for them.  The most recent load is first.
+func queryLoads() ([]loadRecord, error) {
+	rows, err := db.Query(`SELECT load_id, operator, host, version, mode, started, finished, bundle, bundle_sha256, files, failed
+				FROM fits.loader_load l
+				WHERE ($3::timestamptz IS NULL OR started >= $3) AND ($4::timestamptz IS NULL OR started <= $4)
+				AND (($1 = '' AND $2 = '') OR EXISTS (SELECT 1 FROM fits.loader_load_file f
+					WHERE f.load_id = l.load_id AND ($1 = '' OR f.siteID = $1) AND ($2 = '' OR f.typeID = $2)))
+				ORDER BY started DESC`,
+		historySite, historyType, nullTime(historyFrom), nullTime(historyTo))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loads []loadRecord
+
+	for rows.Next() {
+		var l loadRecord
+		var finished sql.NullTime
+
+		err = rows.Scan(&l.id, &l.operator, &l.host, &l.version, &l.mode, &l.started, &finished,
+			&l.bundle, &l.checksum, &l.files, &l.failed)
+		if err != nil {
+			return nil, err
+		}
+		l.finished = finished.Time
+
+		loads = append(loads, l)
+	}
+
+	return loads, rows.Err()
+}
+
+// queryLoadFiles returns the files for historySite and historyType in the loads that started between
+// historyFrom and historyTo.  The most recent load is first.
+func queryLoadFiles() ([]loadFileRecord, error) {
+	rows, err := db.Query(`SELECT f.load_id, f.observation_file, f.siteID || '.' || f.typeID || '.' || f.methodID || '.' || f.sampleID,
+				f.mode, f.observations, f.inserted, f.updated, f.deleted, f.skipped, f.error
+				FROM fits.loader_load_file f JOIN fits.loader_load l USING (load_id)
+				WHERE ($1 = '' OR f.siteID = $1) AND ($2 = '' OR f.typeID = $2)
+				AND ($3::timestamptz IS NULL OR l.started >= $3) AND ($4::timestamptz IS NULL OR l.started <= $4)
+				ORDER BY l.started DESC, f.observation_file`,
+		historySite, historyType, nullTime(historyFrom), nullTime(historyTo))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []loadFileRecord
+
+	for rows.Next() {
+		var f loadFileRecord
+
+		err = rows.Scan(&f.id, &f.file, &f.series, &f.mode, &f.observations, &f.inserted, &f.updated, &f.deleted, &f.skipped, &f.err)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// writeLoads writes a table of loads to w.
+func writeLoads(w io.Writer, loads []loadRecord) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "LOAD ID\tSTARTED\tDURATION\tOPERATOR\tHOST\tVERSION\tMODE\tBUNDLE\tSHA256\tFILES\tFAILED")
+
+	for _, l := range loads {
+		// a load that has not finished is running or was stopped.
+		d := "-"
+		if !l.finished.IsZero() {
+			d = l.finished.Sub(l.started).Round(time.Millisecond).String()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.12s\t%d\t%d\n", l.id, l.started.UTC().Format(time.RFC3339),
+			d, l.operator, l.host, l.version, l.mode, l.bundle, l.checksum, l.files, l.failed)
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d loads\n", len(loads))
+}
+
+// writeLoadFiles writes a table of the files in loads to w.
+func writeLoadFiles(w io.Writer, files []loadFileRecord) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "LOAD ID\tFILE\tSERIES\tMODE\tOBSERVATIONS\tINSERTED\tUPDATED\tDELETED\tSKIPPED\tERROR")
+
+	for _, f := range files {
+		e := f.err
+		if e == "" {
+			e = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%t\t%s\n", f.id, f.file, f.series, f.mode, f.observations,
+			f.inserted, f.updated, f.deleted, f.skipped, e)
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d files\n", len(files))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFSChecksum(t *testing.T) {
+	a, err := fsChecksum(bundle{"VGT2_e.csv": []byte("a"), "VGT2_e.json": []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fsChecksum(bundle{"VGT2_e.csv": []byte("a"), "VGT2_e.json": []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := fsChecksum(bundle{"VGT2_e.csv": []byte("a"), "VGT2_e.json": []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Error("expected different checksums for different contents")
+	}
+
+	if a != c {
+		t.Error("expected the same checksum for the same contents")
+	}
+}
+
+func TestWriteLoads(t *testing.T) {
+	s := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var b bytes.Buffer
+
+	writeLoads(&b, []loadRecord{{id: "20240102T030405.000000Z", operator: "fits", host: "loader", version: vers,
+		mode: "sync-window", started: s, finished: s.Add(1500 * time.Millisecond), bundle: "df.1.tar.gz",
+		checksum: "0123456789abcdef", files: 2, failed: 1},
+		{id: "20240102T040405.000000Z", operator: "fits", host: "loader", version: vers, mode: "delete-first",
+			started: s.Add(time.Hour), bundle: "df.2.tar.gz"}})
+
+	for _, e := range []string{"20240102T030405.000000Z", "2024-01-02T03:04:05Z", "1.5s", "fits", "loader", "sync-window",
+		"df.1.tar.gz", "0123456789ab ", "2024-01-02T04:04:05Z  -  ", "2 loads"} {
+		if !strings.Contains(b.String(), e) {
+			t.Errorf("expected %q in:\n%s", e, b.String())
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	if _, err := db.Exec(`DELETE FROM fits.loader_load WHERE load_id LIKE 'test%'`); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		loadID, loadStarted, historySite = "", false, ""
+	}()
+
+	// a file is still loaded when it can't be recorded, here because the load was not started.
+	loadID = "test-missing"
+
+	if c := loadAll([]data{{sourceFile: "etc/VGT2_e.json", observationFile: "etc/VGT2_e.csv"}}); c != exitOK {
+		t.Errorf("expected exit code %d when the load can't be recorded got %d", exitOK, c)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("didn't find 7 observations in the DB.")
+	}
+
+	cleanDB(t)
+
+	loadID = "test-1"
+
+	proc := []data{
+		{sourceFile: "etc/VGT2_e.json", observationFile: "etc/VGT2_e.csv"},
+		{sourceFile: "etc/errors/missing.json", observationFile: "etc/errors/missing.csv"},
+	}
+
+	start := time.Now().UTC()
+
+	startLoad(mode(), "etc", "abc", start)
+
+	loadAll(proc)
+
+	historySite = "VGT2"
+
+	// the saved file is recorded in the same transaction as it is saved.
+	files, err := queryLoadFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].id != "test-1" || files[0].series != "VGT2.e.bernese5.none" || files[0].inserted != 7 || files[0].err != "" {
+		t.Errorf("expected 7 inserted for VGT2.e.bernese5.none got %+v", files)
+	}
+
+	finishLoad(proc)
+
+	loads, err := queryLoads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loads) != 1 || loads[0].id != "test-1" || loads[0].files != 2 || loads[0].failed != 1 || loads[0].bundle != "etc" || loads[0].finished.IsZero() {
+		t.Errorf("expected finished load test-1 with 2 files and 1 failure got %+v", loads)
+	}
+
+	if files, err = queryLoadFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].inserted != 7 {
+		t.Errorf("expected the saved file to be recorded once got %+v", files)
+	}
+
+	var failed string
+	err = db.QueryRow(`SELECT error FROM fits.loader_load_file WHERE load_id = 'test-1' AND observation_file = 'etc/errors/missing.csv'`).Scan(&failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed == "" {
+		t.Error("expected the error to be recorded for the failed file")
+	}
+
+	// a load whose ID is already in use is not recorded under the other load.
+	startLoad(mode(), "etc", "def", time.Now().UTC())
+
+	if loadStarted {
+		t.Error("expected a load with a duplicate ID not to be started")
+	}
+
+	proc = []data{{sourceFile: "etc/VGT2_e.json", observationFile: "etc/VGT2_e.csv", mode: deleteFirstMode}}
+
+	if c := loadAll(proc); c != exitOK {
+		t.Errorf("expected exit code %d when the load can't be recorded got %d", exitOK, c)
+	}
+
+	finishLoad(proc)
+
+	// the end of the load would otherwise have overwritten the counts for the first load.
+	if loads, err = queryLoads(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loads) != 1 || loads[0].files != 2 || loads[0].failed != 1 || loads[0].checksum != "abc" {
+		t.Errorf("expected only the first load to be recorded got %+v", loads)
+	}
+
+	historySite = "TAUP"
+
+	if loads, err = queryLoads(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loads) != 0 {
+		t.Errorf("expected no loads for TAUP got %+v", loads)
+	}
+
+	if _, err := db.Exec(`DELETE FROM fits.loader_load WHERE load_id LIKE 'test%'`); err != nil {
+		t.Fatal(err)
+	}
+}
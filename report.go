@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// report is a machine readable description of a run of the loader.
+type report struct {
+	Version string       `json:"version"`
+	Mode    string       `json:"mode"`
+	Start   time.Time    `json:"start"`
+	End     time.Time    `json:"end"`
+	Files   []fileReport `json:"files"`
+}
+
+// fileReport describes the outcome of processing a source and observation file.
+type fileReport struct {
+	SourceFile       string            `json:"sourceFile"`
+	ObservationFile  string            `json:"observationFile"`
+	Mode             string            `json:"mode"`
+	Properties       *sourceProperties `json:"properties,omitempty"`
+	Observations     int               `json:"observations"`
+	First            *time.Time        `json:"first,omitempty"`
+	Last             *time.Time        `json:"last,omitempty"`
+	Parsed           bool              `json:"parsed"`
+	Validated        bool              `json:"validated"`
+	Skipped          bool              `json:"skipped"`
+	SiteSaved        bool              `json:"siteSaved"`
+	Inserted         int64             `json:"inserted"`
+	Updated          int64             `json:"updated"`
+	Deleted          int64             `json:"deleted"`
+	ValidationErrors []rowErrorReport  `json:"validationErrors,omitempty"`
+	Truncated        bool              `json:"validationErrorsTruncated,omitempty"`
+	Duplicates       []duplicateReport `json:"duplicates,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+// duplicateReport is a time in more than one row of an observation file and how it was resolved.
+type duplicateReport struct {
+	Time      time.Time `json:"time"`
+	Rows      []int     `json:"rows"`
+	Collision bool      `json:"collision,omitempty"`
+	Policy    string    `json:"policy"`
+	Value     string    `json:"value"`
+	Error     string    `json:"error"`
+}
+
+type rowErrorReport struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// newReport returns a report for the files in proc.
+func newReport(mode string, start time.Time, proc []data) report {
+	r := report{
+		Version: vers,
+		Mode:    mode,
+		Start:   start,
+		End:     time.Now().UTC(),
+		Files:   make([]fileReport, len(proc)),
+	}
+
+	for i := range proc {
+		r.Files[i] = proc[i].report()
+	}
+
+	return r
+}
+
+func (d *data) report() fileReport {
+	f := fileReport{
+		SourceFile:      d.sourceFile,
+		ObservationFile: d.observationFile,
+		Mode:            d.mode.String(),
+		Observations:    d.count(),
+		Parsed:          d.parsed,
+		Validated:       d.validated,
+		Skipped:         d.skipped,
+		SiteSaved:       d.siteSaved,
+		Inserted:        d.inserted,
+		Updated:         d.updated,
+		Deleted:         d.deleted,
+	}
+
+	if d.Properties.SiteID != "" {
+		p := d.Properties
+		f.Properties = &p
+	}
+
+	if first, last, ok := d.span(); ok {
+		f.First, f.Last = &first, &last
+	}
+
+	for _, r := range d.resolved {
+		f.Duplicates = append(f.Duplicates, duplicateReport{
+			Time:      r.t,
+			Rows:      r.rows,
+			Collision: r.collision,
+			Policy:    d.policy.String(),
+			Value:     r.kept.vs,
+			Error:     r.kept.es,
+		})
+	}
+
+	if d.err != nil {
+		f.Error = d.err.Error()
+
+		var v *validationErrors
+		if errors.As(d.err, &v) {
+			for _, e := range v.errs {
+				f.ValidationErrors = append(f.ValidationErrors, rowErrorReport{Row: e.row, Column: e.column, Value: e.value, Reason: e.reason})
+			}
+			f.Truncated = v.truncated
+		}
+	}
+
+	return f
+}
+
+// write writes r as JSON to the file name.
+func (r report) write(name string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(b, '\n'), 0644)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/errors/VGT2_e_multi_error.csv",
+	}
+
+	b, err := os.ReadFile(d.sourceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.unmarshall(b); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(d.observationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	d.err = d.read(f)
+	if d.err == nil {
+		t.Fatal("expected validation errors")
+	}
+
+	name := filepath.Join(t.TempDir(), "report.json")
+
+	if err = newReport("local-validate", time.Now().UTC(), []data{d}).write(name); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r report
+	if err = json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Files) != 1 {
+		t.Fatalf("expected 1 file in the report got %d", len(r.Files))
+	}
+
+	fr := r.Files[0]
+
+	if fr.Properties == nil || fr.Properties.SiteID != "VGT2" {
+		t.Errorf("expected source properties for VGT2 got %+v", fr.Properties)
+	}
+
+	if fr.Observations != 2 {
+		t.Errorf("expected 2 valid observations got %d", fr.Observations)
+	}
+
+	if len(fr.ValidationErrors) != 5 {
+		t.Errorf("expected 5 validation errors got %d", len(fr.ValidationErrors))
+	}
+
+	if fr.Error == "" {
+		t.Error("expected an error message in the report")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	// maxDeletePercent is the largest percentage of the existing observations a sync may remove, 0 for
+	// no limit.
+	maxDeletePercent float64
+	// minSpanPercent is the smallest time span an observation file may cover in a sync as a percentage of
+	// the span of the existing observations, 0 for no limit.
+	minSpanPercent float64
+	// maxRowDrop is the largest number of observations the row count may drop by in a sync, 0 for no
+	// limit.
+	maxRowDrop int64
+	// forceSync is true if a sync goes ahead when it trips a threshold.
+	forceSync bool
+)
+
+// errThreshold is returned when a sync is refused because it trips a threshold.
+var errThreshold = errors.New("refusing to sync")
+
+// syncStats describes the existing observations a sync replaces and the observations replacing them.
+type syncStats struct {
+	// existing and removed are the observations in the sync scope and those that are not in the file.
+	existing, removed int64
+	// rows is the number of observations in the file.
+	rows                   int64
+	existingSpan, fileSpan time.Duration
+}
+
+// checkThresholds checks that syncing the observations in loader_observation to the series k will
+// not trip a threshold.  With forceSync the tripped thresholds are logged and the sync goes ahead.
+func (d *data) checkThresholds(tx *sql.Tx, k seriesKey) error {
+	if maxDeletePercent <= 0 && minSpanPercent <= 0 && maxRowDrop <= 0 {
+		return nil
+	}
+
+	st, err := d.syncStats(tx, k)
+	if err != nil {
+		return err
+	}
+
+	tripped := st.check()
+	if len(tripped) == 0 {
+		return nil
+	}
+
+	if forceSync {
+		for _, t := range tripped {
+			log.Printf("WARNING - %s: %s, continuing with --force", d.observationFile, t)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s, use --force to override", errThreshold, strings.Join(tripped, "; "))
+}
+
+// syncStats returns the stats for syncing the observations in loader_observation to the series k.
+func (d *data) syncStats(tx *sql.Tx, k seriesKey) (st syncStats, err error) {
+	var first, last sql.NullTime
+
+	where, args := d.scope(k)
+
+	q := `SELECT count(*), min(time), max(time) FROM ` + d.obsTable() + ` ` + where
+
+	if err = tx.QueryRow(q, args...).Scan(&st.existing, &first, &last); err != nil {
+		return st, err
+	}
+
+	if first.Valid {
+		st.existingSpan = last.Time.Sub(first.Time)
+	}
+
+	q, args = d.removedQuery(k, "count(*)")
+
+	if err = tx.QueryRow(q, args...).Scan(&st.removed); err != nil {
+		return st, err
+	}
+
+	if err = tx.QueryRow(`SELECT count(*), min(time), max(time) FROM loader_observation`).Scan(&st.rows, &first, &last); err != nil {
+		return st, err
+	}
+
+	if first.Valid {
+		st.fileSpan = last.Time.Sub(first.Time)
+	}
+
+	return st, nil
+}
+
+// check returns a description of each threshold tripped by st.
+func (st syncStats) check() (tripped []string) {
+	if st.existing == 0 {
+		return nil
+	}
+
+	if p := float64(st.removed) / float64(st.existing) * 100; maxDeletePercent > 0 && p > maxDeletePercent {
+		tripped = append(tripped, fmt.Sprintf("would remove %d of %d existing observations (%.1f%%), more than --max-delete-percent %g",
+			st.removed, st.existing, p, maxDeletePercent))
+	}
+
+	if minSpanPercent > 0 && st.existingSpan > 0 {
+		if p := float64(st.fileSpan) / float64(st.existingSpan) * 100; p < minSpanPercent {
+			tripped = append(tripped, fmt.Sprintf("the file covers %s, %.1f%% of the %s covered by the existing observations, less than --min-span-percent %g",
+				st.fileSpan, p, st.existingSpan, minSpanPercent))
+		}
+	}
+
+	if drop := st.existing - st.rows; maxRowDrop > 0 && drop > maxRowDrop {
+		tripped = append(tripped, fmt.Sprintf("the row count would drop by %d from %d to %d, more than --max-row-drop %d",
+			drop, st.existing, st.rows, maxRowDrop))
+	}
+
+	return tripped
+}
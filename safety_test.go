@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncStatsCheck(t *testing.T) {
+	defer func() {
+		maxDeletePercent, minSpanPercent, maxRowDrop = 0, 0, 0
+	}()
+
+	maxDeletePercent, minSpanPercent, maxRowDrop = 50, 50, 10
+
+	in := []struct {
+		id      string
+		st      syncStats
+		tripped []string
+	}{
+		{id: "no existing", st: syncStats{rows: 10, fileSpan: time.Hour}},
+		{id: "ok", st: syncStats{existing: 100, removed: 50, rows: 90, existingSpan: 10 * time.Hour, fileSpan: 5 * time.Hour}},
+		{id: "delete", st: syncStats{existing: 100, removed: 51, rows: 100, existingSpan: time.Hour, fileSpan: time.Hour},
+			tripped: []string{"would remove 51 of 100 existing observations (51.0%)"}},
+		{id: "span", st: syncStats{existing: 100, rows: 100, existingSpan: 10 * time.Hour, fileSpan: 4 * time.Hour},
+			tripped: []string{"the file covers 4h0m0s, 40.0% of the 10h0m0s"}},
+		{id: "drop", st: syncStats{existing: 100, removed: 11, rows: 89, existingSpan: time.Hour, fileSpan: time.Hour},
+			tripped: []string{"the row count would drop by 11 from 100 to 89"}},
+		{id: "all", st: syncStats{existing: 100, removed: 100, rows: 1, existingSpan: time.Hour},
+			tripped: []string{"would remove", "the file covers", "the row count would drop"}},
+	}
+
+	for _, v := range in {
+		tripped := v.st.check()
+
+		if len(tripped) != len(v.tripped) {
+			t.Errorf("%s: expected %d thresholds tripped got %v", v.id, len(v.tripped), tripped)
+			continue
+		}
+
+		for i := range tripped {
+			if !strings.HasPrefix(tripped[i], v.tripped[i]) {
+				t.Errorf("%s: expected %q got %q", v.id, v.tripped[i], tripped[i])
+			}
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	defer func() {
+		maxDeletePercent, forceSync = 0, false
+	}()
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := d.parseAndValidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.saveSite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateOrAdd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keep 2 of the 7 observations.
+	d.obs = d.obs[:2]
+
+	maxDeletePercent = 50
+
+	err := d.deleteThenSave()
+	if !errors.Is(err, errThreshold) || !strings.Contains(err.Error(), "would remove 5 of 7 existing observations") {
+		t.Errorf("expected the delete threshold to trip got %v", err)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("expected nothing deleted after refusing the sync")
+	}
+
+	forceSync = true
+
+	if err = d.deleteThenSave(); err != nil {
+		t.Errorf("expected --force to override the threshold got %s", err)
+	}
+
+	if countObs(t) != 2 {
+		t.Error("didn't find 2 observations in the DB.")
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 var (
-	checkType    *sql.Stmt
-	checkSample  *sql.Stmt
+	checkType   *sql.Stmt
+	checkSample *sql.Stmt
 )
 
 // initSource should be called after the db is available.
@@ -38,14 +39,25 @@ func initSource() (err error) {
 }
 
 type source struct {
-	Properties  sourceProperties
-	Type        string
-	Coordinates []float64
+	Properties  sourceProperties `json:"properties"`
+	Type        string           `json:"type"`
+	Coordinates []float64        `json:"coordinates"`
 }
 
 type sourceProperties struct {
-	SiteID, Name, TypeID, MethodID, SampleID, SystemID string
-	Height, GroundRelationship                                    float64
+	SiteID             string  `json:"siteID"`
+	Name               string  `json:"name"`
+	TypeID             string  `json:"typeID"`
+	MethodID           string  `json:"methodID"`
+	SampleID           string  `json:"sampleID"`
+	SystemID           string  `json:"systemID"`
+	Height             float64 `json:"height"`
+	GroundRelationship float64 `json:"groundRelationship"`
+	// WindowStart and WindowEnd optionally bound the observations replaced by a windowed sync.
+	WindowStart *time.Time `json:"windowStart,omitempty"`
+	WindowEnd   *time.Time `json:"windowEnd,omitempty"`
+	// Duplicates is the optional policy for observations at the same time e.g., last.
+	Duplicates string `json:"duplicates,omitempty"`
 }
 
 func (s *source) longitude() float64 {
@@ -70,6 +82,12 @@ func (s *source) unmarshall(b []byte) (err error) {
 		return fmt.Errorf("didn't find correct coordinates for point")
 	}
 
+	if s.Properties.Duplicates != "" {
+		if _, err = parseDupPolicy(s.Properties.Duplicates); err != nil {
+			return err
+		}
+	}
+
 	if s.Properties.SampleID == "" {
 		s.Properties.SampleID = "none"
 	}
@@ -81,6 +99,11 @@ func (s *source) unmarshall(b []byte) (err error) {
 	return err
 }
 
+// seriesName returns the name of the series for s e.g., VGT2.e.bernese5.none.
+func (s *source) seriesName() string {
+	return fmt.Sprintf("%s.%s.%s.%s", s.Properties.SiteID, s.Properties.TypeID, s.Properties.MethodID, s.Properties.SampleID)
+}
+
 func (s *source) valid() (err error) {
 	var d string
 
@@ -104,13 +127,26 @@ func (s *source) valid() (err error) {
 }
 
 func (s *source) saveSite() (err error) {
-	_, err = addSite.Exec(
+	_, err = addSite.Exec(s.siteArgs()...)
+
+	return err
+}
+
+// saveSiteTx is saveSite using tx.
+func (s *source) saveSiteTx(tx *sql.Tx) (err error) {
+	_, err = tx.Stmt(addSite).Exec(s.siteArgs()...)
+
+	return err
+}
+
+// siteArgs returns the arguments for fits.add_site.
+func (s *source) siteArgs() []interface{} {
+	return []interface{}{
 		s.Properties.SiteID,
 		s.Properties.Name,
 		s.longitude(),
 		s.latitude(),
 		s.Properties.Height,
-		s.Properties.GroundRelationship)
-
-	return err
+		s.Properties.GroundRelationship,
+	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/url"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+var (
+	queueURL, deadLetterURL string
+	sqsWait, sqsVisibility  int
+)
+
+// sqsFlags adds the flags for the serve-sqs command.
+func sqsFlags() {
+	flag.StringVar(&queueURL, "queue-url", "", "URL of the SQS queue to receive S3 event notifications from.")
+	flag.StringVar(&deadLetterURL, "dead-letter-url", "", "optional URL of an SQS queue to move messages for bundles that fail to load to.")
+	awsFlags()
+	flag.IntVar(&sqsWait, "wait-time", 20, "SQS long poll wait time in seconds.")
+	flag.IntVar(&sqsVisibility, "visibility-timeout", 300, "SQS visibility timeout in seconds.  This must be longer than it takes to load a bundle.")
+}
+
+// s3Event is the S3 event notification in the body of an SQS message.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+}
+
+// sqsServer receives S3 event notifications from an SQS queue and loads the bundle
+// for each created object.
+type sqsServer struct {
+	sqs                     *sqs.Client
+	s3                      *s3.Client
+	queueURL, deadLetterURL string
+	wait, visibility        int32
+	// load loads the files in b and returns an exit code.  name is the base name of the S3 object.
+	load func(b bundle, name string) int
+}
+
+// serveSQS runs the serve-sqs command until it is interrupted.
+func serveSQS() int {
+	if queueURL == "" {
+		fatal("please specify the SQS queue URL")
+	}
+
+	if !locValid {
+		if err := config.initDB(); err != nil {
+			fatal(err)
+		}
+		defer db.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	s, err := newSQSServer(ctx)
+	if err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+
+	log.Printf("receiving S3 events from %s", s.queueURL)
+
+	s.serve(ctx)
+
+	return exitOK
+}
+
+// newSQSServer returns an sqsServer configured from the command line.
+func newSQSServer(ctx context.Context) (*sqsServer, error) {
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqsServer{
+		sqs: sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+			if awsEndpoint != "" {
+				o.BaseEndpoint = aws.String(awsEndpoint)
+			}
+		}),
+		s3:            newS3Client(cfg),
+		queueURL:      queueURL,
+		deadLetterURL: deadLetterURL,
+		wait:          int32(sqsWait),
+		visibility:    int32(sqsVisibility),
+		load:          loadBundle,
+	}, nil
+}
+
+// serve receives and handles messages until ctx is done.
+func (s *sqsServer) serve(ctx context.Context) {
+	for ctx.Err() == nil {
+		out, err := s.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.queueURL),
+			MaxNumberOfMessages: 1,
+			WaitTimeSeconds:     s.wait,
+			VisibilityTimeout:   s.visibility,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR - receiving SQS message: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+
+		for _, m := range out.Messages {
+			s.handle(ctx, m)
+		}
+	}
+}
+
+// handle loads the S3 objects in the event in m.  The message and the objects are deleted if every
+// object loads, moved to the dead letter queue (or left to be redelivered) if any files fail, and
+// left to be redelivered if the DB or S3 are not available.  Objects are only deleted once every
+// object has loaded so a redelivered message can load them all again.
+func (s *sqsServer) handle(ctx context.Context, m types.Message) {
+	log.Println("received event from SQS")
+
+	var e s3Event
+	if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &e); err != nil {
+		log.Printf("ERROR - parsing SQS message body: %s", err)
+		s.reject(ctx, m)
+		return
+	}
+
+	code := exitOK
+
+	type object struct{ bucket, key string }
+	var loaded []object
+
+	for _, r := range e.Records {
+		if !strings.HasPrefix(r.EventName, "ObjectCreated:") {
+			log.Printf("event was not an S3 ObjectCreated, was: '%s'", r.EventName)
+			continue
+		}
+
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			log.Printf("ERROR - decoding S3 object key %s: %s", r.S3.Object.Key, err)
+			code = max(code, exitFailed)
+			continue
+		}
+
+		c := s.loadObject(ctx, r.S3.Bucket.Name, key)
+		if c == exitOK {
+			loaded = append(loaded, object{bucket: r.S3.Bucket.Name, key: key})
+		}
+
+		code = max(code, c)
+	}
+
+	switch code {
+	case exitOK:
+		for _, o := range loaded {
+			if _, err := s.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)}); err != nil {
+				log.Printf("ERROR - deleting s3://%s/%s: %s", o.bucket, o.key, err)
+			}
+		}
+
+		log.Println("removing processed event")
+		s.delete(ctx, m)
+	case exitFailed:
+		s.reject(ctx, m)
+	default:
+		log.Println("leaving event to be redelivered")
+	}
+}
+
+// loadObject downloads the bundle in bucket/key to memory and loads it.
+func (s *sqsServer) loadObject(ctx context.Context, bucket, key string) int {
+	log.Printf("loading s3://%s/%s", bucket, key)
+
+	out, err := s.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	// a missing object will never load so the message must not be redelivered forever.
+	var missing *s3types.NoSuchKey
+	if errors.As(err, &missing) {
+		log.Printf("ERROR - getting s3://%s/%s: %s", bucket, key, err)
+		return exitFailed
+	}
+	if err != nil {
+		log.Printf("ERROR - getting s3://%s/%s: %s", bucket, key, err)
+		return exitConfig
+	}
+	defer out.Body.Close()
+
+	b, err := readArchive(out.Body)
+	if err != nil {
+		log.Printf("ERROR - reading s3://%s/%s: %s", bucket, key, err)
+		return exitFailed
+	}
+
+	return s.load(b, path.Base(key))
+}
+
+// reject moves m to the dead letter queue if there is one, otherwise it is left to be redelivered.
+func (s *sqsServer) reject(ctx context.Context, m types.Message) {
+	if s.deadLetterURL == "" {
+		log.Println("leaving failed event to be redelivered")
+		return
+	}
+
+	_, err := s.sqs.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.deadLetterURL),
+		MessageBody: m.Body,
+	})
+	if err != nil {
+		log.Printf("ERROR - moving event to the dead letter queue: %s", err)
+		return
+	}
+
+	log.Println("moved failed event to the dead letter queue")
+	s.delete(ctx, m)
+}
+
+func (s *sqsServer) delete(ctx context.Context, m types.Message) {
+	_, err := s.sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.queueURL),
+		ReceiptHandle: m.ReceiptHandle,
+	})
+	if err != nil {
+		log.Printf("ERROR - deleting SQS message: %s", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeAWS is a minimal stand-in for the SQS and S3 APIs used by sqsServer.
+type fakeAWS struct {
+	sync.Mutex
+	body      string
+	objects   map[string][]byte
+	deleted   []string // receipt handles
+	sent      []string // queue URLs
+	s3Deleted []string
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		var in map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+		switch target {
+		case "AmazonSQS.ReceiveMessage":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Messages": []map[string]string{{"MessageId": "1", "ReceiptHandle": "rh-1", "Body": f.body}},
+			})
+		case "AmazonSQS.DeleteMessage":
+			f.deleted = append(f.deleted, in["ReceiptHandle"].(string))
+			w.Write([]byte("{}"))
+		case "AmazonSQS.SendMessage":
+			f.sent = append(f.sent, in["QueueUrl"].(string))
+			w.Write([]byte(`{"MessageId": "2"}`))
+		default:
+			http.Error(w, "unknown target "+target, http.StatusBadRequest)
+		}
+		return
+	}
+
+	// path style S3 requests.
+	switch r.Method {
+	case http.MethodGet:
+		b, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = b
+	case http.MethodDelete:
+		f.s3Deleted = append(f.s3Deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unknown method", http.StatusBadRequest)
+	}
+}
+
+func TestSQSServer(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	b := tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json")
+
+	f := &fakeAWS{
+		body:    `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"fits-spool"},"object":{"key":"df.1234.tar.gz"}}}]}`,
+		objects: map[string][]byte{"/fits-spool/df.1234.tar.gz": b},
+	}
+
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	awsEndpoint, awsRegion = ts.URL, "ap-southeast-2"
+	defer func() { awsEndpoint, awsRegion = "", "" }()
+
+	ctx := context.Background()
+
+	s, err := newSQSServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.queueURL = ts.URL + "/queue/fits"
+
+	in := []struct {
+		id            string
+		code          int
+		deadLetterURL string
+		deleted, sent int
+		s3Deleted     int
+	}{
+		{id: "loaded", code: exitOK, deleted: 1, s3Deleted: 1},
+		{id: "failed without a dead letter queue", code: exitFailed},
+		{id: "failed with a dead letter queue", code: exitFailed, deadLetterURL: ts.URL + "/queue/fits-dlq", deleted: 1, sent: 1},
+		{id: "DB not available", code: exitConfig, deadLetterURL: ts.URL + "/queue/fits-dlq"},
+	}
+
+	for _, v := range in {
+		f.deleted, f.sent, f.s3Deleted = nil, nil, nil
+		s.deadLetterURL = v.deadLetterURL
+
+		var files []string
+		var bundleName string
+
+		s.load = func(b bundle, name string) int {
+			bundleName = name
+			for _, d := range scanArchive(b) {
+				files = append(files, d.observationFile, d.sourceFile)
+			}
+			return v.code
+		}
+
+		out, err := s.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(s.queueURL)})
+		if err != nil {
+			t.Fatalf("%s: %s", v.id, err)
+		}
+
+		for _, m := range out.Messages {
+			s.handle(ctx, m)
+		}
+
+		if bundleName != "df.1234.tar.gz" {
+			t.Errorf("%s: expected bundle df.1234.tar.gz got %s", v.id, bundleName)
+		}
+
+		if strings.Join(files, ",") != "VGT2_e.csv,VGT2_e.json" {
+			t.Errorf("%s: expected the bundle to be unpacked got %v", v.id, files)
+		}
+
+		if len(f.deleted) != v.deleted {
+			t.Errorf("%s: expected %d SQS messages deleted got %d", v.id, v.deleted, len(f.deleted))
+		}
+
+		if len(f.sent) != v.sent {
+			t.Errorf("%s: expected %d SQS messages sent to the dead letter queue got %d", v.id, v.sent, len(f.sent))
+		}
+
+		if len(f.s3Deleted) != v.s3Deleted {
+			t.Errorf("%s: expected %d S3 objects deleted got %d", v.id, v.s3Deleted, len(f.s3Deleted))
+		}
+	}
+}
+
+func TestSQSServerMissingObject(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	// the second object is missing, e.g., it was deleted after an earlier delivery.
+	f := &fakeAWS{
+		body: `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"fits-spool"},"object":{"key":"1.tar.gz"}}},
+			{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"fits-spool"},"object":{"key":"2.tar.gz"}}}]}`,
+		objects: map[string][]byte{"/fits-spool/1.tar.gz": tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json")},
+	}
+
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	awsEndpoint, awsRegion = ts.URL, "ap-southeast-2"
+	defer func() { awsEndpoint, awsRegion = "", "" }()
+
+	ctx := context.Background()
+
+	s, err := newSQSServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.queueURL = ts.URL + "/queue/fits"
+	s.deadLetterURL = ts.URL + "/queue/fits-dlq"
+
+	var loaded []string
+
+	s.load = func(b bundle, name string) int {
+		loaded = append(loaded, name)
+		return exitOK
+	}
+
+	out, err := s.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(s.queueURL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range out.Messages {
+		s.handle(ctx, m)
+	}
+
+	if strings.Join(loaded, ",") != "1.tar.gz" {
+		t.Errorf("expected 1.tar.gz to be loaded got %v", loaded)
+	}
+
+	if len(f.s3Deleted) != 0 {
+		t.Errorf("expected no S3 objects deleted when the message failed got %v", f.s3Deleted)
+	}
+
+	if len(f.sent) != 1 || len(f.deleted) != 1 {
+		t.Errorf("expected the message moved to the dead letter queue got %d sent %d deleted", len(f.sent), len(f.deleted))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+)
+
+// stagingTable is the temporary copy of fits.observation used by a staged load.
+const stagingTable = "staging_observation"
+
+var (
+	// stagingLoad is true if files are loaded into a staging copy of the observations and
+	// verified before they are published to the live tables.
+	stagingLoad bool
+	// verifyOnly is true if a staged load is verified and then rolled back without publishing.
+	verifyOnly bool
+	// valueMargin is how far, as a multiple of the live value range, staged values may be outside
+	// the live value range.  A negative margin turns the check off.
+	valueMargin = 1.0
+)
+
+// errVerify is returned when the staged observations fail verification.
+var errVerify = errors.New("staged observations failed verification, not publishing")
+
+// errVerifyOnly is returned to roll back a staged load that passed verification with --verify-only.
+var errVerifyOnly = errors.New("staged observations verified, not publishing with --verify-only")
+
+// staging holds the series written to the staging table in a transaction.
+type staging struct {
+	series []*stagedSeries
+	seen   map[seriesKey]*stagedSeries
+}
+
+// stagedSeries is a series copied from the live table to the staging table along with the
+// observations written to it from files.
+type stagedSeries struct {
+	key               seriesKey
+	name              string
+	inserted, deleted int64
+	// first and last are the time span of the observations in the files.
+	first, last time.Time
+	observed    bool
+}
+
+// seriesStats describes the observations for a series in a table.  min and max are the NUMERIC
+// values as text as they may be beyond the range of a float64.
+type seriesStats struct {
+	rows        int64
+	first, last sql.NullTime
+	min, max    sql.NullString
+}
+
+// newStaging makes tx serializable and creates the staging table for tx.  It is dropped when tx ends.
+// It must be called before anything else is done in tx.  publish replaces the live series with the
+// copies taken when they were staged so tx fails to commit, rather than losing the change, if another
+// transaction changes a staged series in between.
+func newStaging(tx *sql.Tx) (*staging, error) {
+	if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL SERIALIZABLE`); err != nil {
+		return nil, err
+	}
+
+	_, err := tx.Exec(`CREATE TEMPORARY TABLE ` + stagingTable + ` (
+				LIKE fits.observation INCLUDING DEFAULTS,
+				PRIMARY KEY (sitePK, typePK, methodPK, samplePK, time)
+				) ON COMMIT DROP`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staging{seen: make(map[seriesKey]*stagedSeries)}, nil
+}
+
+// save saves the site for d using tx and writes the observations to the staging table.  The live
+// observations for the series are copied to the staging table the first time it is seen.
+func (s *staging) save(tx *sql.Tx, d *data) error {
+	log.Printf("saving site information from %s", d.sourceFile)
+	if err := d.saveSiteTx(tx); err != nil {
+		return err
+	}
+	d.siteSaved = true
+
+	k, err := d.seriesKey(tx)
+	if err != nil {
+		return err
+	}
+
+	ss, ok := s.seen[k]
+	if !ok {
+		_, err = tx.Exec(`INSERT INTO `+stagingTable+` SELECT * FROM fits.observation
+				WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`,
+			k.sitePK, k.typePK, k.methodPK, k.samplePK)
+		if err != nil {
+			return err
+		}
+
+		ss = &stagedSeries{key: k, name: d.seriesName()}
+		s.seen[k] = ss
+		s.series = append(s.series, ss)
+	}
+
+	d.table = stagingTable
+	if err = d.write(tx); err != nil {
+		return err
+	}
+
+	ss.inserted += d.inserted
+	ss.deleted += d.deleted
+
+	if first, last, ok := d.span(); ok {
+		if !ss.observed || first.Before(ss.first) {
+			ss.first = first
+		}
+		if !ss.observed || last.After(ss.last) {
+			ss.last = last
+		}
+		ss.observed = true
+	}
+
+	return nil
+}
+
+// stats returns the stats for the series k in table.
+func stats(tx *sql.Tx, table string, k seriesKey) (st seriesStats, err error) {
+	err = tx.QueryRow(`SELECT count(*), min(time), max(time), min(value)::text, max(value)::text FROM `+table+`
+				WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`,
+		k.sitePK, k.typePK, k.methodPK, k.samplePK).Scan(&st.rows, &st.first, &st.last, &st.min, &st.max)
+
+	return st, err
+}
+
+// verify compares each staged series with the live series.  It checks that the number of staged rows
+// matches the rows written, that the staged time range includes the observations from the files, and
+// that the staged values are within valueMargin of the live value range.  Every series is logged and
+// errVerify is returned if any check fails.
+func (s *staging) verify(tx *sql.Tx) error {
+	var failed bool
+
+	for _, ss := range s.series {
+		live, err := stats(tx, "fits.observation", ss.key)
+		if err != nil {
+			return err
+		}
+
+		staged, err := stats(tx, stagingTable, ss.key)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("verifying %s: live %s, staged %s", ss.name, live, staged)
+
+		for _, p := range ss.check(live, staged) {
+			log.Printf("ERROR - verifying %s: %s", ss.name, p)
+			failed = true
+		}
+	}
+
+	if failed {
+		return errVerify
+	}
+
+	return nil
+}
+
+// check returns the problems found comparing the staged stats for ss with the live stats.
+func (ss *stagedSeries) check(live, staged seriesStats) (problems []string) {
+	if expected := live.rows - ss.deleted + ss.inserted; staged.rows != expected {
+		problems = append(problems, fmt.Sprintf("expected %d staged rows (%d live, %d deleted, %d inserted) found %d",
+			expected, live.rows, ss.deleted, ss.inserted, staged.rows))
+	}
+
+	if ss.observed && (!staged.first.Valid || staged.first.Time.After(ss.first) || staged.last.Time.Before(ss.last)) {
+		problems = append(problems, fmt.Sprintf("staged time range does not include the observations from %s to %s",
+			ss.first.Format(time.RFC3339Nano), ss.last.Format(time.RFC3339Nano)))
+	}
+
+	if valueMargin >= 0 && live.min.Valid && staged.min.Valid {
+		if m, ok := outsideMargin(live, staged); ok {
+			problems = append(problems, fmt.Sprintf("staged values %s to %s are outside the live values %s to %s by more than a margin of %s",
+				staged.min.String, staged.max.String, live.min.String, live.max.String, m.Text('g', 6)))
+		}
+	}
+
+	return problems
+}
+
+// outsideMargin returns the margin and true if the staged values are outside the live values by more
+// than valueMargin times the live range.  The margin is relative to the largest live magnitude when that
+// is bigger than the range, so a series with a single live value can still change.  The values are
+// compared exactly.  Values that can't be compared, e.g., NaN, are not checked.
+func outsideMargin(live, staged seriesStats) (*big.Float, bool) {
+	var v [4]*big.Rat
+
+	for i, s := range []string{live.min.String, live.max.String, staged.min.String, staged.max.String} {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, false
+		}
+		v[i] = r
+	}
+
+	lmin, lmax, smin, smax := v[0], v[1], v[2], v[3]
+
+	m := new(big.Rat).Sub(lmax, lmin)
+	for _, r := range []*big.Rat{lmin, lmax} {
+		if a := new(big.Rat).Abs(r); a.Cmp(m) > 0 {
+			m = a
+		}
+	}
+
+	f := new(big.Rat).SetFloat64(valueMargin)
+	if f == nil {
+		// an infinite margin.
+		return nil, false
+	}
+	m.Mul(m, f)
+
+	if smin.Cmp(new(big.Rat).Sub(lmin, m)) >= 0 && smax.Cmp(new(big.Rat).Add(lmax, m)) <= 0 {
+		return nil, false
+	}
+
+	return new(big.Float).SetRat(m), true
+}
+
+func (st seriesStats) String() string {
+	if st.rows == 0 {
+		return "0 rows"
+	}
+
+	return fmt.Sprintf("%d rows from %s to %s values %s to %s", st.rows,
+		st.first.Time.Format(time.RFC3339Nano), st.last.Time.Format(time.RFC3339Nano), st.min.String, st.max.String)
+}
+
+// publish replaces the live observations for each staged series with the staged observations.
+func (s *staging) publish(tx *sql.Tx) error {
+	for _, ss := range s.series {
+		k := ss.key
+
+		_, err := tx.Exec(`DELETE FROM fits.observation WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`,
+			k.sitePK, k.typePK, k.methodPK, k.samplePK)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO fits.observation SELECT * FROM `+stagingTable+`
+				WHERE sitepk = $1 AND typepk = $2 AND methodpk = $3 AND samplepk = $4`,
+			k.sitePK, k.typePK, k.methodPK, k.samplePK)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("published %s", ss.name)
+	}
+
+	return nil
+}
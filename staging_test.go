@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStagedSeriesCheck(t *testing.T) {
+	first := time.Date(2012, 7, 31, 12, 1, 4, 0, time.UTC)
+	last := time.Date(2012, 8, 6, 12, 1, 4, 0, time.UTC)
+
+	stat := func(rows int64, min, max float64) seriesStats {
+		return seriesStats{
+			rows:  rows,
+			first: sql.NullTime{Time: first, Valid: true},
+			last:  sql.NullTime{Time: last, Valid: true},
+			min:   sql.NullString{String: strconv.FormatFloat(min, 'g', -1, 64), Valid: true},
+			max:   sql.NullString{String: strconv.FormatFloat(max, 'g', -1, 64), Valid: true},
+		}
+	}
+
+	ss := stagedSeries{inserted: 2, deleted: 1, first: first, last: last, observed: true}
+
+	if p := ss.check(stat(10, -2, 2), stat(11, -3, 3)); len(p) != 0 {
+		t.Errorf("expected no problems got %v", p)
+	}
+
+	if p := ss.check(stat(10, -2, 2), stat(12, -3, 3)); len(p) != 1 {
+		t.Errorf("expected a problem with the row count got %v", p)
+	}
+
+	// the live range is 4 so values can be up to 4 outside it.
+	if p := ss.check(stat(10, -2, 2), stat(11, -3, 6.5)); len(p) != 1 {
+		t.Errorf("expected a problem with the value range got %v", p)
+	}
+
+	// values beyond the range of a float64 are compared exactly.
+	big := func(rows int64, min, max string) seriesStats {
+		st := stat(rows, 0, 0)
+		st.min.String, st.max.String = min, max
+		return st
+	}
+
+	if p := ss.check(big(10, "1e400", "2e400"), big(11, "-1e400", "4e400")); len(p) != 0 {
+		t.Errorf("expected no problems got %v", p)
+	}
+
+	if p := ss.check(big(10, "1e400", "2e400"), big(11, "1e400", "4"+strings.Repeat("0", 400)+".1")); len(p) != 1 {
+		t.Errorf("expected a problem with the value range got %v", p)
+	}
+
+	ss.last = last.Add(time.Hour)
+
+	if p := ss.check(stat(10, -2, 2), stat(11, -3, 3)); len(p) != 1 {
+		t.Errorf("expected a problem with the time range got %v", p)
+	}
+
+	m := valueMargin
+	defer func() { valueMargin = m }()
+	valueMargin = -1
+
+	ss.last = last
+
+	if p := ss.check(stat(10, -2, 2), stat(11, -300, 300)); len(p) != 0 {
+		t.Errorf("expected no problems with the value check off got %v", p)
+	}
+}
+
+func TestLoadStaged(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	s := stagingLoad
+	defer func() { stagingLoad = s }()
+	stagingLoad = true
+
+	a, err := readArchive(bytes.NewReader(tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := loadAtomic(scanArchive(a)); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("didn't find 7 observations in the DB.")
+	}
+
+	// a verified load is rolled back with --verify-only.
+	defer func() { verifyOnly = false }()
+	verifyOnly = true
+
+	a["VGT2_e.csv"] = []byte("date time, e (mm), error (mm)\n2012-08-07T12:01:04.000000Z,1.0,4.64\n")
+
+	proc := scanArchive(a)
+
+	if c := loadAtomic(proc); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if countObs(t) != 7 || proc[0].inserted != 0 || proc[0].err != nil {
+		t.Errorf("expected nothing published with --verify-only got %d inserted error %v", proc[0].inserted, proc[0].err)
+	}
+
+	verifyOnly = false
+
+	// values far outside the live range fail verification and nothing is published.
+	a["VGT2_e.csv"] = []byte("date time, e (mm), error (mm)\n2012-08-07T12:01:04.000000Z,1000.0,4.64\n")
+
+	proc = scanArchive(a)
+
+	if c := loadAtomic(proc); c != exitFailed {
+		t.Errorf("expected exit code %d got %d", exitFailed, c)
+	}
+
+	if countObs(t) != 7 {
+		t.Error("didn't find 7 observations in the DB.")
+	}
+
+	// a series with values beyond the range of a float64 can be staged and verified.
+	a["VGT2_e.csv"] = []byte("date time, e (mm), error (mm)\n2012-08-07T12:01:04.000000Z,1e400,4.64\n")
+
+	if c := loadAtomic(scanArchive(a)); c != exitFailed {
+		t.Errorf("expected exit code %d for a value far outside the live range got %d", exitFailed, c)
+	}
+
+	defer func(m float64) { valueMargin = m }(valueMargin)
+	valueMargin = -1
+
+	if c := loadAtomic(scanArchive(a)); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	valueMargin = 1
+
+	a["VGT2_e.csv"] = []byte("date time, e (mm), error (mm)\n2012-08-08T12:01:04.000000Z,-1e400,4.64\n")
+
+	if c := loadAtomic(scanArchive(a)); c != exitOK {
+		t.Errorf("expected exit code %d got %d", exitOK, c)
+	}
+
+	if countObs(t) != 9 {
+		t.Error("didn't find 9 observations in the DB.")
+	}
+}
+
+func TestStagedCompetingWrite(t *testing.T) {
+	setup()
+	defer teardown()
+
+	cleanDB(t)
+
+	d := data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+	}
+
+	if err := process(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	d = data{
+		sourceFile:      "etc/VGT2_e.json",
+		observationFile: "etc/VGT2_e.csv",
+		mode:            deleteFirstMode,
+	}
+
+	if err := validate(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	s, err := newStaging(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.save(tx, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	// another loader changes the series after it was copied to the staging table.
+	_, err = db.Exec(`UPDATE fits.observation SET value = 10 WHERE time = '2012-08-01T11:58:56Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.publish(tx); err == nil {
+		err = tx.Commit()
+	}
+
+	if err == nil {
+		t.Error("expected publishing to fail after a competing write")
+	}
+
+	var v float64
+	if err = db.QueryRow(`SELECT value FROM fits.observation WHERE time = '2012-08-01T11:58:56Z'`).Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v != 10 {
+		t.Errorf("expected the competing write to be kept got %g", v)
+	}
+}
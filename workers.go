@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// loadParallel processes proc using workers goroutines and returns the exit code in the same way as
+// loadAll.  All files are validated first, in any order.  The valid files are then loaded with up to
+// workers at a time, limited by the size of the DB pool.  Files for the same site are loaded one at a
+// time in the order they are in proc so two files for a series never race.
+func loadParallel(proc []data) int {
+	var failed, stop atomic.Bool
+
+	run := func(jobs [][]int, n int, f func(*data) error) {
+		c := make(chan []int)
+		var wg sync.WaitGroup
+
+		for w := 0; w < n; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range c {
+					for _, i := range job {
+						if stop.Load() || proc[i].err != nil {
+							continue
+						}
+
+						if err := f(&proc[i]); err != nil {
+							log.Printf("ERROR - processing %s: %s", proc[i].observationFile, err)
+							failed.Store(true)
+							if failFast {
+								stop.Store(true)
+							}
+						}
+					}
+				}
+			}()
+		}
+
+		for _, job := range jobs {
+			c <- job
+		}
+		close(c)
+
+		wg.Wait()
+	}
+
+	each := make([][]int, len(proc))
+	for i := range proc {
+		each[i] = []int{i}
+	}
+
+	run(each, workers, validate)
+
+	if !(dryRun || locValid) {
+		run(bySite(proc), loaders(), load)
+	}
+
+	if !failed.Load() {
+		return exitOK
+	}
+
+	// there is no point carrying on if the DB has gone away.
+	if !locValid {
+		if err := db.Ping(); err != nil {
+			log.Printf("ERROR - DB not available: %s", err)
+			return exitConfig
+		}
+	}
+
+	return exitFailed
+}
+
+// loaders returns the number of files that can be loaded at the same time.  Each load uses
+// one DB connection at a time.
+func loaders() int {
+	if m := db.Stats().MaxOpenConnections; m > 0 && m < workers {
+		return m
+	}
+
+	return workers
+}
+
+// bySite returns the indexes of proc grouped by site ID in the order the sites are first seen.  Saving
+// the site is shared by every type at a site so files are grouped by site rather than series.
+func bySite(proc []data) [][]int {
+	var groups [][]int
+	seen := make(map[string]int)
+
+	for i := range proc {
+		id := proc[i].Properties.SiteID
+
+		g, ok := seen[id]
+		if !ok {
+			g = len(groups)
+			seen[id] = g
+			groups = append(groups, nil)
+		}
+
+		groups[g] = append(groups[g], i)
+	}
+
+	return groups
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBySite(t *testing.T) {
+	proc := []data{
+		{source: source{Properties: sourceProperties{SiteID: "VGT2", TypeID: "e"}}},
+		{source: source{Properties: sourceProperties{SiteID: "TAUP", TypeID: "e"}}},
+		{source: source{Properties: sourceProperties{SiteID: "VGT2", TypeID: "n"}}},
+		{source: source{Properties: sourceProperties{SiteID: "VGT2", TypeID: "e"}}},
+	}
+
+	expected := [][]int{{0, 2, 3}, {1}}
+
+	if g := bySite(proc); !reflect.DeepEqual(expected, g) {
+		t.Errorf("expected %v got %v", expected, g)
+	}
+}
+
+func TestLoadParallel(t *testing.T) {
+	l, w := locValid, workers
+	defer func() { locValid, workers = l, w }()
+	locValid = true
+	workers = 4
+
+	a, err := readArchive(bytes.NewReader(tarball(t, "etc/VGT2_e.csv", "etc/VGT2_e.json", "etc/errors/VGT2_e_dups.csv")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc := scanArchive(a)
+
+	if c := loadAll(proc); c != exitFailed {
+		t.Errorf("expected exit code %d got %d", exitFailed, c)
+	}
+
+	for _, d := range proc {
+		switch d.observationFile {
+		case "VGT2_e.csv":
+			if !d.validated || d.err != nil {
+				t.Errorf("expected %s to validate got %v", d.observationFile, d.err)
+			}
+		default:
+			if d.err == nil {
+				t.Errorf("expected an error for %s", d.observationFile)
+			}
+		}
+	}
+}